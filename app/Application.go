@@ -43,7 +43,9 @@ func GetApplication() *Application {
 func (app *Application) Run() error {
 	configPathFromEnv, _ := os.LookupEnv("CONFIG_PATH")
 	var configPath string
+	var printSpiders bool
 	flag.StringVar(&configPath, "c", "", "config file path")
+	flag.BoolVar(&printSpiders, "print-spiders", false, "print spider configs with templates resolved, then exit")
 	flag.Parse()
 	if len(configPath) == 0 {
 		configPath = configPathFromEnv
@@ -63,8 +65,22 @@ func (app *Application) Run() error {
 		fmt.Fprintln(os.Stderr, "decode config file failed", "configPath", configPath, "error", err)
 		os.Exit(1)
 	}
+	if printSpiders {
+		data, err := app.appConfig.ResolvedSpidersYAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "encode spider configs failed", "error", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(data)
+		os.Exit(0)
+	}
 	// init logger
 	util.InitLogger(app.appConfig.Logger)
+	// init http record/replay
+	if err = util.InitHTTPFixture(app.appConfig.HTTPFixtureConfig); err != nil {
+		slog.Error("init http fixture failed", "error", err)
+		os.Exit(1)
+	}
 	// init runtime config
 	app.runtimeConfig = runtimeConfig.NewConfigFromPath(path.Join(app.appConfig.WorkDir, "/runtimeConfig.yaml"))
 	// register plugins
@@ -147,6 +163,7 @@ func (app *Application) shutdown() {
 		}
 	}
 	app.runtimeConfig.Save()
+	util.CloseHTTPFixture()
 	slog.Info("shutdown finish")
 }
 
@@ -22,3 +22,90 @@ CREATE INDEX IF NOT EXISTS idx_images_id ON images (id);
 CREATE INDEX IF NOT EXISTS idx_images_tags ON images USING GIN (tags);
 CREATE INDEX IF NOT EXISTS idx_images_source_id ON images (source_id);
 CREATE INDEX IF NOT EXISTS idx_images_post_time ON images (post_time);
+
+--本地文件占用的磁盘大小, 用于统计配额
+ALTER TABLE images ADD COLUMN IF NOT EXISTS file_size BIGINT;
+
+--图片尺寸, 以及下载失败的原因
+ALTER TABLE images ADD COLUMN IF NOT EXISTS width INT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS height INT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS download_error TEXT;
+
+--每个 source 每天的用量
+CREATE TABLE IF NOT EXISTS source_usage (
+    source_id TEXT NOT NULL,
+    day DATE NOT NULL,
+    posts BIGINT NOT NULL DEFAULT 0,
+    download_bytes BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (source_id, day)
+);
+
+--下载状态, 已有的数据根据 local_path 设置状态: NULL 等待下载, 空字符串为之前下载失败的, next_retry_at 为空时立即重试
+ALTER TABLE images ADD COLUMN IF NOT EXISTS download_status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS download_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMP;
+UPDATE images SET download_status = 'done' WHERE download_status = 'pending' AND local_path != '';
+UPDATE images SET download_status = 'failed', download_attempts = 1 WHERE download_status = 'pending' AND local_path = '';
+--上次退出时没有完成的下载
+UPDATE images SET download_status = 'pending' WHERE download_status = 'downloading';
+CREATE INDEX IF NOT EXISTS idx_images_download_status ON images (source_id, download_status);
+
+--下载优先级, 越大越优先, 通过 API 请求的图片会提高优先级
+ALTER TABLE images ADD COLUMN IF NOT EXISTS download_priority INT NOT NULL DEFAULT 0;
+
+--按内容保存的文件, 内容相同的图片共用一个文件, ref_count 为引用这个文件的图片数量
+ALTER TABLE images ADD COLUMN IF NOT EXISTS content_hash TEXT;
+CREATE INDEX IF NOT EXISTS idx_images_content_hash ON images (content_hash);
+CREATE TABLE IF NOT EXISTS blobs (
+    content_hash TEXT PRIMARY KEY,
+    local_path TEXT NOT NULL,
+    file_size BIGINT,
+    ref_count INT NOT NULL DEFAULT 0
+);
+
+--相似图片检测, phash 为 dHash, preview_url 为预览图
+ALTER TABLE images ADD COLUMN IF NOT EXISTS phash BIGINT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS preview_url TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS phash BIGINT;
+
+--保留的原始文件
+ALTER TABLE images ADD COLUMN IF NOT EXISTS original_path TEXT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS original_size BIGINT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS original_mime_type TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS original_path TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS original_size BIGINT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS original_mime_type TEXT;
+
+--文件种类, image / animated / video
+ALTER TABLE images ADD COLUMN IF NOT EXISTS media_type TEXT NOT NULL DEFAULT 'image';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS media_type TEXT NOT NULL DEFAULT 'image';
+
+--多个版本的图片地址, 以及实际保存的版本
+ALTER TABLE images ADD COLUMN IF NOT EXISTS image_url_candidates JSONB;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS image_variant TEXT;
+
+--只需要执行一次的迁移, 执行之后记录名字
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    name TEXT PRIMARY KEY,
+    applied_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+--缩小的图片, rendition 的名字对应存储中的路径, 之前的版本只有 @320.heic
+--只在添加这一列时补上一次, 之后 renditions 为空表示没有缩小的图片; 文件不存在的 rendition 由 DataChecker 删除
+ALTER TABLE images ADD COLUMN IF NOT EXISTS renditions JSONB;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS renditions JSONB;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM schema_migrations WHERE name = 'backfill_renditions_320') THEN
+        UPDATE images SET renditions = jsonb_build_object('320', regexp_replace(local_path, '\.heic$', '@320.heic'))
+            WHERE renditions IS NULL AND local_path LIKE '%.heic';
+        UPDATE blobs SET renditions = jsonb_build_object('320', regexp_replace(local_path, '\.heic$', '@320.heic'))
+            WHERE renditions IS NULL AND local_path LIKE '%.heic';
+        INSERT INTO schema_migrations (name) VALUES ('backfill_renditions_320');
+    END IF;
+END
+$$;
+
+--ImageMeta.Hash, 下载的临时文件用它命名, 清理临时文件时按它查找对应的数据
+ALTER TABLE images ADD COLUMN IF NOT EXISTS meta_hash TEXT GENERATED ALWAYS AS (md5(source_id || '-' || id)) STORED;
+CREATE INDEX IF NOT EXISTS idx_images_meta_hash ON images (meta_hash);
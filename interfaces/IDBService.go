@@ -1,6 +1,9 @@
 package interfaces
 
-import "ywwzwb/imagespider/models"
+import (
+	"time"
+	"ywwzwb/imagespider/models"
+)
 
 const DBServiceID ServiceID = "IDBService"
 
@@ -8,10 +11,36 @@ type IDBService interface {
 	InitSource(id string) error
 	GetMeta(id, source string) (*models.ImageMeta, bool)
 	InsertMeta(meta models.ImageMeta) error
-	GetMetaLocalPathNULL(source string, maxSize int) []models.ImageMeta
+	// UpdateImageURL 保存重新读取的图片地址
+	UpdateImageURL(meta models.ImageMeta) error
+	GetMetaToDownload(source string, watchedTags []string, maxSize int) []models.ImageMeta
+	CountMetaToDownload(source string) (int64, error)
+	// UpdateLocalPathForMeta 保存本地路径, 同时维护 content hash 对应的 blob 的引用计数
 	UpdateLocalPathForMeta(meta models.ImageMeta) error
+	GetBlob(contentHash string) (*models.Blob, error)
+	UpdateDownloadStatus(meta models.ImageMeta, status models.DownloadStatus) error
+	MarkMetaDownloadFailed(meta models.ImageMeta, reason string, nextRetryAt *time.Time) error
+	ListDownloadFailures(source string, status models.DownloadStatus, offset, limit int64) (*models.ImageList, error)
+	RequeueFailedDownloads(source string, ids []string) (int64, error)
+	MarkMetaDownloadSkipped(meta models.ImageMeta, reason string) error
+	FindSimilarImage(phash int64, maxDistance int) (*models.ImageMeta, error)
+	ListPerceptualHashes(source string) ([]models.ImageMeta, error)
+	// FilterPendingDownloadHashes 返回 hashes(ImageMeta.Hash) 中还没有下载完成的数据对应的 hash 和 source
+	FilterPendingDownloadHashes(hashes []string) (map[string]string, error)
+	// PrioritizeDownload 修改下载优先级, 失败的数据会重新等待下载, 返回修改之后的状态
+	PrioritizeDownload(source, id string, priority int) (models.DownloadStatus, error)
 
 	ListNotGroupTags(source string, offset, limit int64) (*models.TagList, error)
 	ListDownloadedImageOfTags(source string, tags []string, offset, limit int64) (*models.ImageList, error)
 	GetImageMeta(source string, id string) (*models.ImageMeta, error)
+
+	AddSourceUsage(source string, day time.Time, posts, downloadBytes int64) error
+	GetSourceUsage(source string, day time.Time) (posts, downloadBytes int64, err error)
+	// GetSourceDiskUsage 返回 source 占用的空间, 没有记录大小的文件按平均大小估算
+	GetSourceDiskUsage(source string) (int64, error)
+	// ListMetaWithoutFileSize 和 UpdateFileSize 用于补上之前的版本没有记录的文件大小
+	ListMetaWithoutFileSize(source string, offset, limit int64) ([]models.ImageMeta, error)
+	UpdateFileSize(meta models.ImageMeta) error
+	// UpdateRenditions 更新缩小的图片, 用于删除文件不存在的 rendition
+	UpdateRenditions(meta models.ImageMeta) error
 }
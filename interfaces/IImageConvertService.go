@@ -1,7 +1,22 @@
 package interfaces
 
+import "ywwzwb/imagespider/models"
+
 const ImageConvertServiceID ServiceID = "ImageConvert"
 
+// IImageConvertService 转换下载的文件, 每个 source 可以使用不同的配置, 同时生成配置的 rendition(backend 支持时)
 type IImageConvertService interface {
-	ConvertHEIC(input, output string) error
+	ConvertHEIC(sourceID, input, output string) error
+	// ConvertAnimated 转换动图, 保留所有帧, 缩略图使用第一帧
+	ConvertAnimated(sourceID, input, output string) error
+	// ConvertVideo 保存或者转码视频, 缩略图使用第一帧
+	ConvertVideo(sourceID, input, output string) error
+	// OutputExtension 返回转换之后的文件的扩展名, sourceMediaType 为下载的文件的类型
+	OutputExtension(sourceID string, mediaType models.MediaType, sourceMediaType string) string
+	// RenditionSuffixes 返回 source 配置的 rendition 的名字和文件名后缀, 后缀加在转换之后的文件去掉扩展名的路径上
+	RenditionSuffixes(sourceID string) map[string]string
+	// Resize 把图片的第一帧缩小到 width 宽, 输出的格式由 output 的扩展名决定
+	Resize(sourceID, input, output string, width int) error
+	// PerceptualHash 计算图片的 dHash, 用于查找相似的图片
+	PerceptualHash(input string) (uint64, error)
 }
@@ -1,9 +1,28 @@
 package interfaces
 
-import "ywwzwb/imagespider/models/config"
+import (
+	"context"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+)
 
 const ImageDownloaderDownloaderServiceID ServiceID = "ImageDownloader"
 
+// ImageURLRefresher 重新读取 meta 页面, 返回最新的图片地址, 用于地址带有会过期的签名的网站
+type ImageURLRefresher func(meta models.ImageMeta) ([]models.ImageURLCandidate, error)
+
 type IImageDownloaderService interface {
-	AddConfig(sourceID string, config *config.ImageDownloaderConfig)
+	// AddConfig 添加一个 source 并开始下载, refresher 可以为 nil
+	AddConfig(sourceID string, config *config.ImageDownloaderConfig, refresher ImageURLRefresher)
+	// RequestDownload 让图片优先下载, wait 为 true 时等待下载完成(成功或失败)或者 ctx 结束
+	RequestDownload(ctx context.Context, sourceID, metaID string, wait bool) error
+
+	// SetBandwidth 临时修改带宽限制, 优先于配置中的限制和时间表, sourceID 为空时修改全局的限制
+	SetBandwidth(sourceID string, rate, burst int64) error
+	// ResetBandwidth 取消 SetBandwidth 的修改, 恢复使用配置
+	ResetBandwidth(sourceID string) error
+	GetBandwidth() []models.BandwidthLimit
+
+	// GetStatus 返回每个 source 的队列以及正在处理的下载
+	GetStatus() models.DownloaderStatus
 }
@@ -0,0 +1,16 @@
+package interfaces
+
+import "ywwzwb/imagespider/models"
+
+const QuotaServiceID ServiceID = "Quota"
+
+type IQuotaService interface {
+	AllowNewPost(sourceID string) bool
+	AddPost(sourceID string)
+	AllowDownload(sourceID string) bool
+	AddDownloadBytes(sourceID string, size int64)
+	AddDiskBytes(sourceID string, size int64)
+	// RefreshDiskUsage 删除文件或者补上文件大小之后, 从数据库重新读取占用的空间
+	RefreshDiskUsage(sourceID string)
+	GetUsage(sourceID string) (*models.QuotaUsage, error)
+}
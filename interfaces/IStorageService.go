@@ -0,0 +1,26 @@
+package interfaces
+
+import (
+	"io"
+	"time"
+	"ywwzwb/imagespider/models"
+)
+
+const StorageServiceID ServiceID = "Storage"
+
+// IStorageService 图片文件的存储, key 为相对路径, 例如 ab/cd/ef/abcdef.heic
+// 文件不存在时 Get 和 Stat 返回 NotFound
+type IStorageService interface {
+	Put(key string, reader io.Reader, size int64, contentType string) error
+	// PutFile 保存本地文件, 调用之后 localPath 可能已经被移走了
+	PutFile(key, localPath, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (*models.StorageObject, error)
+	Delete(key string) error
+	// List 遍历 prefix 下的所有文件, fn 返回错误时停止
+	List(prefix string, fn func(object models.StorageObject) error) error
+	// LocalPath 返回本地文件的路径, 不是本地存储时返回 false
+	LocalPath(key string) (string, bool)
+	// PresignedURL 返回可以直接下载的临时地址, 不支持时返回 false
+	PresignedURL(key string, expires time.Duration) (string, bool, error)
+}
@@ -0,0 +1,12 @@
+package interfaces
+
+import "ywwzwb/imagespider/models"
+
+const TempJanitorServiceID ServiceID = "TempJanitor"
+
+type ITempJanitorService interface {
+	// Sweep 立即清理一次
+	Sweep() models.JanitorReport
+	// LastReport 返回上一次清理的结果, 还没有清理过时返回 nil
+	LastReport() *models.JanitorReport
+}
@@ -0,0 +1,8 @@
+package models
+
+type BandwidthLimit struct {
+	SourceID string `json:"sourceID" yaml:"sourceID"` // 为空时表示全局的限制
+	Rate     int64  `json:"rate" yaml:"rate"`         // bytes/s, 0 表示不限制
+	Burst    int64  `json:"burst" yaml:"burst"`
+	Override bool   `json:"override" yaml:"override"` // 是否是通过 API 临时设置的
+}
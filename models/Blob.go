@@ -0,0 +1,15 @@
+package models
+
+// Blob 按内容(sha256)保存的文件, 内容相同的图片共用一个文件
+type Blob struct {
+	ContentHash      string
+	LocalPath        string
+	FileSize         *int64
+	PerceptualHash   *int64
+	OriginalPath     *string
+	OriginalSize     *int64
+	OriginalMimeType *string
+	MediaType        MediaType
+	Renditions       map[string]string
+	RefCount         int
+}
@@ -0,0 +1,17 @@
+package models
+
+// DownloadStatus 图片的下载状态
+type DownloadStatus string
+
+const (
+	DownloadStatusPending           DownloadStatus = "pending"            // 等待下载
+	DownloadStatusDownloading       DownloadStatus = "downloading"        // 正在下载或转换
+	DownloadStatusDone              DownloadStatus = "done"               // 已经保存到本地
+	DownloadStatusFailed            DownloadStatus = "failed"             // 下载失败, 到 NextRetryAt 之后重试
+	DownloadStatusPermanentlyFailed DownloadStatus = "permanently_failed" // 不再自动重试, 只能通过 API 重新加入队列
+	DownloadStatusSkipped           DownloadStatus = "skipped"            // 预览图和已有的图片相似, 没有下载
+)
+
+func (s DownloadStatus) IsFailed() bool {
+	return s == DownloadStatusFailed || s == DownloadStatusPermanentlyFailed
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// DownloadProgress 一个正在处理的下载
+type DownloadProgress struct {
+	SourceID    string    `json:"sourceID" yaml:"sourceID"`
+	MetaID      string    `json:"metaID" yaml:"metaID"`
+	URL         string    `json:"url" yaml:"url"`
+	Stage       string    `json:"stage" yaml:"stage"` // waiting, downloading, converting, saving
+	StartTime   time.Time `json:"startTime" yaml:"startTime"`
+	ResumedFrom int64     `json:"resumedFrom" yaml:"resumedFrom"` // 断点续传的起始位置
+	BytesDone   int64     `json:"bytesDone" yaml:"bytesDone"`     // 包含 ResumedFrom
+	BytesTotal  int64     `json:"bytesTotal" yaml:"bytesTotal"`   // 未知时为 -1
+	Speed       int64     `json:"speed" yaml:"speed"`             // bytes/s, 本次请求的平均速度
+}
+
+// SourceDownloadStatus 一个 source 的下载队列
+type SourceDownloadStatus struct {
+	SourceID    string `json:"sourceID" yaml:"sourceID"`
+	Parallelism int    `json:"parallelism" yaml:"parallelism"`
+	InFlight    int    `json:"inFlight" yaml:"inFlight"`
+	QueueDepth  int64  `json:"queueDepth" yaml:"queueDepth"` // 等待下载或者到了重试时间的数量
+}
+
+type DownloaderStatus struct {
+	Sources   []SourceDownloadStatus `json:"sources" yaml:"sources"`
+	Downloads []DownloadProgress     `json:"downloads" yaml:"downloads"`
+}
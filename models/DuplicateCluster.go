@@ -0,0 +1,6 @@
+package models
+
+// DuplicateCluster 一组相似的图片
+type DuplicateCluster struct {
+	Images []ImageMeta `json:"images" yaml:"images"`
+}
@@ -11,9 +11,34 @@ type ImageMeta struct {
 	ID        string
 	Tags      []string
 	LocalPath *string
-	ImageURL  string
-	PostTime  time.Time
-	SourceID  string
+	FileSize  *int64 // 本地文件占用的磁盘大小
+	// 下载的原始文件的 sha256, 内容相同的图片共用同一个本地文件
+	ContentHash *string
+	// 保留的原始文件, 没有开启 KeepOriginal 时为空
+	OriginalPath     *string
+	OriginalSize     *int64
+	OriginalMimeType *string
+	MediaType        MediaType // 图片, 动图或视频
+	// 缩小的图片, rendition 的名字对应存储中的路径
+	Renditions map[string]string
+	// 转换之后计算的 dHash, 用于查找相似的图片
+	PerceptualHash   *int64
+	Width            *int
+	Height           *int
+	DownloadStatus   DownloadStatus
+	DownloadAttempts int
+	DownloadPriority int
+	// 下载失败的原因, 下载成功时为空
+	DownloadError *string
+	NextRetryAt   *time.Time
+	ImageURL      string
+	// 按优先级排列的图片地址, 第一个和 ImageURL 相同, 只配置了一个地址时为空
+	ImageURLCandidates []ImageURLCandidate
+	// 实际保存的版本, 对应 ImageURLCandidate.Variant
+	ImageVariant *string
+	PreviewURL   *string // 预览图, 用于下载之前检查是否和已有的图片相似
+	PostTime     time.Time
+	SourceID     string
 }
 
 func (i *ImageMeta) Hash() string {
@@ -21,3 +46,11 @@ func (i *ImageMeta) Hash() string {
 	md5 := md5.Sum([]byte(id))
 	return hex.EncodeToString(md5[:])
 }
+
+// Candidates 返回按优先级排列的图片地址, 没有多个版本时只有 ImageURL
+func (i *ImageMeta) Candidates() []ImageURLCandidate {
+	if len(i.ImageURLCandidates) != 0 {
+		return i.ImageURLCandidates
+	}
+	return []ImageURLCandidate{{URL: i.ImageURL}}
+}
@@ -0,0 +1,7 @@
+package models
+
+// ImageURLCandidate 同一张图片的不同版本(原图, 大图, 缩小的图片等)的地址
+type ImageURLCandidate struct {
+	Variant string `json:"variant" yaml:"variant"`
+	URL     string `json:"url" yaml:"url"`
+}
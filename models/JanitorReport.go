@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// JanitorReport 一次清理临时目录的结果
+type JanitorReport struct {
+	StartTime      time.Time `json:"startTime" yaml:"startTime"`
+	ScannedFiles   int       `json:"scannedFiles" yaml:"scannedFiles"`
+	KeptFiles      int       `json:"keptFiles" yaml:"keptFiles"`
+	DeletedFiles   int       `json:"deletedFiles" yaml:"deletedFiles"`
+	ReclaimedBytes int64     `json:"reclaimedBytes" yaml:"reclaimedBytes"`
+	Error          string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
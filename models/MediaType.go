@@ -0,0 +1,10 @@
+package models
+
+// MediaType 下载的文件的种类, 决定转换的方式
+type MediaType string
+
+const (
+	MediaTypeImage    MediaType = "image"    // 静态图片, 转换成 heic
+	MediaTypeAnimated MediaType = "animated" // gif / apng / webp 动图
+	MediaTypeVideo    MediaType = "video"    // mp4 / webm
+)
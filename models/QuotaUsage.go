@@ -0,0 +1,12 @@
+package models
+
+type QuotaUsage struct {
+	SourceID               string `json:"sourceID" yaml:"sourceID"`
+	Day                    string `json:"day" yaml:"day"`
+	Posts                  int64  `json:"posts" yaml:"posts"`
+	DownloadBytes          int64  `json:"downloadBytes" yaml:"downloadBytes"`
+	DiskBytes              int64  `json:"diskBytes" yaml:"diskBytes"`
+	MaxPostsPerDay         int64  `json:"maxPostsPerDay" yaml:"maxPostsPerDay"`
+	MaxDownloadBytesPerDay int64  `json:"maxDownloadBytesPerDay" yaml:"maxDownloadBytesPerDay"`
+	MaxDiskBytes           int64  `json:"maxDiskBytes" yaml:"maxDiskBytes"`
+}
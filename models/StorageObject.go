@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// StorageObject 存储中的一个文件
+type StorageObject struct {
+	Key          string    `json:"key" yaml:"key"`
+	Size         int64     `json:"size" yaml:"size"`
+	LastModified time.Time `json:"lastModified" yaml:"lastModified"`
+}
@@ -1,5 +1,13 @@
 package config
 
 type APIConfig struct {
-	Port int `json:"port" yaml:"port"`
+	Port   int          `json:"port" yaml:"port"`
+	Resize ResizeConfig `json:"resize" yaml:"resize"`
+}
+
+// ResizeConfig 按需生成指定宽度的图片, 只允许配置中的宽度和格式, 生成的图片缓存在 WorkDir 中
+type ResizeConfig struct {
+	Widths       []int    `json:"widths" yaml:"widths"`             // 为空时不允许调整大小
+	Formats      []string `json:"formats" yaml:"formats"`           // heic, avif, webp, jpeg 或 png, 为空时允许 webp 和 jpeg
+	CacheMaxSize int64    `json:"cacheMaxSize" yaml:"cacheMaxSize"` // in MB, 默认 1024
 }
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// TimeOfDay 一天中的时间, 配置中写成 HH:MM, 保存为距离 00:00 的分钟数
+type TimeOfDay int
+
+func (t *TimeOfDay) fromString(s string) error {
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return errors.New("invalid time of day: " + s)
+	}
+	*t = TimeOfDay(parsed.Hour()*60 + parsed.Minute())
+	return nil
+}
+func (t *TimeOfDay) UnmmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return t.fromString(s)
+}
+func (t *TimeOfDay) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return t.fromString(s)
+}
+
+// BandwidthScheduleConfig 在 [from, to) 时间段内使用的带宽, to 小于 from 时表示跨过零点
+type BandwidthScheduleConfig struct {
+	From  TimeOfDay `json:"from" yaml:"from"`
+	To    TimeOfDay `json:"to" yaml:"to"`
+	Rate  int64     `json:"rate" yaml:"rate"`   // bytes/s, 0 表示不限制
+	Burst int64     `json:"burst" yaml:"burst"` // bytes, 为 0 时等于 rate
+}
+
+func (s *BandwidthScheduleConfig) contains(t time.Time) bool {
+	minute := TimeOfDay(t.Hour()*60 + t.Minute())
+	if s.From <= s.To {
+		return minute >= s.From && minute < s.To
+	}
+	return minute >= s.From || minute < s.To
+}
+
+type BandwidthConfig struct {
+	Rate     int64                     `json:"rate" yaml:"rate"`   // bytes/s, 0 表示不限制
+	Burst    int64                     `json:"burst" yaml:"burst"` // bytes, 为 0 时等于 rate
+	Schedule []BandwidthScheduleConfig `json:"schedule" yaml:"schedule"`
+}
+
+// LimitAt 返回 t 时刻的带宽限制, 匹配到多个时间段时使用第一个
+func (b *BandwidthConfig) LimitAt(t time.Time) (rate, burst int64) {
+	for _, schedule := range b.Schedule {
+		if schedule.contains(t) {
+			return schedule.Rate, schedule.Burst
+		}
+	}
+	return b.Rate, b.Burst
+}
@@ -4,15 +4,21 @@ import "encoding/json"
 
 type SpiderList map[string]*SpiderConfig
 type Config struct {
-	Spiders            SpiderList         `json:"spiders" yaml:"spiders"`
-	ImageConvertConfig ImageConvertConfig `json:"imageConverter" yaml:"imageConverter"`
-	Logger             LoggerConfig       `json:"logger" yaml:"logger"`
-	ImageDir           string             `json:"imageDir" yaml:"imageDir"`
-	WorkDir            string             `json:"workDir" yaml:"workDir"`
-	DatabaseConfig     DatabaseConfig     `json:"database" yaml:"database"`
-	Plugins            []string           `json:"plugins" yaml:"plugins"`
-	APIConfig          APIConfig          `json:"api" yaml:"api"`
-	DataCheckerConfig  DataCheckerConfig  `json:"dataChecker" yaml:"dataChecker"`
+	Spiders            SpiderList             `json:"spiders" yaml:"-"` // 由 UnmarshalYAML 展开模板之后解析
+	SpiderTemplates    map[string]map[any]any `json:"spiderTemplates" yaml:"spiderTemplates"`
+	ImageConvertConfig ImageConvertConfig     `json:"imageConverter" yaml:"imageConverter"`
+	Logger             LoggerConfig           `json:"logger" yaml:"logger"`
+	ImageDir           string                 `json:"imageDir" yaml:"imageDir"`
+	Storage            StorageConfig          `json:"storage" yaml:"storage"`
+	WorkDir            string                 `json:"workDir" yaml:"workDir"`
+	DatabaseConfig     DatabaseConfig         `json:"database" yaml:"database"`
+	Plugins            []string               `json:"plugins" yaml:"plugins"`
+	APIConfig          APIConfig              `json:"api" yaml:"api"`
+	DataCheckerConfig  DataCheckerConfig      `json:"dataChecker" yaml:"dataChecker"`
+	TempJanitorConfig  TempJanitorConfig      `json:"tempJanitor" yaml:"tempJanitor"`
+	HTTPFixtureConfig  HTTPFixtureConfig      `json:"httpFixture" yaml:"httpFixture"`
+	DownloadBandwidth  BandwidthConfig        `json:"downloadBandwidth" yaml:"downloadBandwidth"` // 所有图片下载共享的带宽
+	resolvedSpiders    map[string]map[any]any
 }
 
 func (a *SpiderList) UnmmarshalJSON(data []byte) error {
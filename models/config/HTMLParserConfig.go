@@ -3,29 +3,33 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/antchfx/xpath"
 )
 
-type AttributeType int
+// AttributeType 是元素上用于取值的属性, innertext 表示元素文本, 其他值为元素的同名属性
+type AttributeType string
 
 const (
-	AttributeTypeInnerText AttributeType = iota
-	AttributeTypeHref
-	AttributeTypeTitle
+	AttributeTypeInnerText AttributeType = "innertext"
+	AttributeTypeHref      AttributeType = "href"
+	AttributeTypeTitle     AttributeType = "title"
 )
 
 func (a *AttributeType) fromString(s string) error {
-	switch strings.ToLower(s) {
-	case "innertext":
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return errors.New("attribute is empty")
+	}
+	if strings.ToLower(s) == string(AttributeTypeInnerText) {
 		*a = AttributeTypeInnerText
-	case "href":
-		*a = AttributeTypeHref
-	case "title":
-		*a = AttributeTypeTitle
-	default:
-		return errors.New("invalid attribute type: " + s)
+		return nil
 	}
+	*a = AttributeType(s)
 	return nil
 }
 func (a *AttributeType) UnmmarshalJSON(data []byte) error {
@@ -47,17 +51,54 @@ type OperatorType int
 
 const (
 	OperatorContain OperatorType = iota
+	OperatorEquals
+	OperatorPrefix
+	OperatorSuffix
+	OperatorRegex
+	OperatorGreaterThan
+	OperatorGreaterEqual
+	OperatorLessThan
+	OperatorLessEqual
+	OperatorHasAttribute
 )
 
 func (o *OperatorType) fromString(s string) error {
 	switch strings.ToLower(s) {
 	case "contains":
 		*o = OperatorContain
+	case "equals", "eq":
+		*o = OperatorEquals
+	case "prefix":
+		*o = OperatorPrefix
+	case "suffix":
+		*o = OperatorSuffix
+	case "regex":
+		*o = OperatorRegex
+	case "gt":
+		*o = OperatorGreaterThan
+	case "ge":
+		*o = OperatorGreaterEqual
+	case "lt":
+		*o = OperatorLessThan
+	case "le":
+		*o = OperatorLessEqual
+	case "has-attribute", "has":
+		*o = OperatorHasAttribute
 	default:
-		return errors.New("invalid attribute type: " + s)
+		return errors.New("invalid operator type: " + s)
 	}
 	return nil
 }
+
+// IsNumeric 数值比较类的操作符, value 需要是数字
+func (o OperatorType) IsNumeric() bool {
+	switch o {
+	case OperatorGreaterThan, OperatorGreaterEqual, OperatorLessThan, OperatorLessEqual:
+		return true
+	default:
+		return false
+	}
+}
 func (o *OperatorType) UnmmarshalJSON(data []byte) error {
 	// ignore case when unmarshal
 	var s string
@@ -79,9 +120,158 @@ type ReplacerConfig struct {
 	Regex       *regexp.Regexp
 	Replacement string
 }
+type TransformType int
+
+const (
+	TransformTrim TransformType = iota
+	TransformLowercase
+	TransformReplace
+	TransformCapture
+	TransformSplit
+	TransformResolveURL
+	TransformURLDecode
+	TransformHTMLUnescape
+	TransformPrefix
+	TransformSuffix
+)
+
+func (t *TransformType) fromString(s string) error {
+	switch strings.ToLower(s) {
+	case "trim":
+		*t = TransformTrim
+	case "lowercase":
+		*t = TransformLowercase
+	case "replace":
+		*t = TransformReplace
+	case "capture":
+		*t = TransformCapture
+	case "split":
+		*t = TransformSplit
+	case "resolveurl":
+		*t = TransformResolveURL
+	case "urldecode":
+		*t = TransformURLDecode
+	case "htmlunescape":
+		*t = TransformHTMLUnescape
+	case "prefix":
+		*t = TransformPrefix
+	case "suffix":
+		*t = TransformSuffix
+	default:
+		return errors.New("invalid transform type: " + s)
+	}
+	return nil
+}
+
+// TransformConfig 对取到的值做的一步变换
+// 无参数的变换直接写名字, 例如 trim; 有参数的变换写成只有一个 key 的 map, 例如:
+//
+//	transforms:
+//	  - split: ","
+//	  - trim
+//	  - replace: {regex: "\\s+", replacement: "_"}
+//	  - capture: {regex: "id=(\\d+)", group: 1}
+//	  - prefix: "tag_"
+type TransformConfig struct {
+	Type        TransformType
+	Argument    string         // trim 的字符集, split 的分隔符, prefix / suffix 的内容
+	Regex       *regexp.Regexp // replace / capture 的表达式
+	Replacement string         // replace 的替换内容
+	Group       int            // capture 的分组, 默认为 1
+}
+
+func (t *TransformConfig) fromObject(v interface{}) error {
+	if s, ok := v.(string); ok {
+		if err := t.Type.fromString(s); err != nil {
+			return err
+		}
+		switch t.Type {
+		case TransformReplace, TransformCapture, TransformSplit, TransformPrefix, TransformSuffix:
+			return errors.New("transform " + s + " requires an argument")
+		}
+		return nil
+	}
+	m, ok := v.(map[any]any)
+	if !ok || len(m) != 1 {
+		return errors.New("transform must be a string or a map with single key")
+	}
+	for k, arg := range m {
+		name, ok := k.(string)
+		if !ok {
+			return errors.New("transform name must be a string")
+		}
+		if err := t.Type.fromString(name); err != nil {
+			return err
+		}
+		switch t.Type {
+		case TransformReplace:
+			argMap, ok := arg.(map[any]any)
+			if !ok {
+				return errors.New("replace must be a map")
+			}
+			regex, err := regexFromObject(argMap["regex"])
+			if err != nil {
+				return err
+			}
+			t.Regex = regex
+			replacement, ok := argMap["replacement"].(string)
+			if !ok {
+				return errors.New("replacement is required and must be a string")
+			}
+			t.Replacement = replacement
+		case TransformCapture:
+			t.Group = 1
+			regexObject := arg
+			if argMap, ok := arg.(map[any]any); ok {
+				regexObject = argMap["regex"]
+				if group, ok := argMap["group"]; ok {
+					groupInt, ok := group.(int)
+					if !ok || groupInt < 0 {
+						return errors.New("group must be a non-negative int")
+					}
+					t.Group = groupInt
+				}
+			}
+			regex, err := regexFromObject(regexObject)
+			if err != nil {
+				return err
+			}
+			if t.Group > regex.NumSubexp() {
+				return errors.New("group out of range: " + regex.String())
+			}
+			t.Regex = regex
+		default:
+			if arg == nil {
+				break
+			}
+			argStr, ok := arg.(string)
+			if !ok {
+				return errors.New("argument of " + name + " must be a string")
+			}
+			t.Argument = argStr
+		}
+		if t.Type == TransformSplit && len(t.Argument) == 0 {
+			return errors.New("separator of split is required")
+		}
+	}
+	return nil
+}
+func regexFromObject(v interface{}) (*regexp.Regexp, error) {
+	regexStr, ok := v.(string)
+	if !ok {
+		return nil, errors.New("regex is required and must be a string")
+	}
+	regex, err := regexp.Compile(regexStr)
+	if err != nil {
+		return nil, errors.New("invalid regex: " + regexStr + ", error" + err.Error())
+	}
+	return regex, nil
+}
+
 type ValueConfig struct {
 	Attribute      AttributeType
 	ReplacerConfig *ReplacerConfig
+	Transforms     []TransformConfig // 按顺序执行, 在 replacer 之后
 }
 
 func (a *ValueConfig) fromObject(v interface{}) error {
@@ -104,6 +294,19 @@ func (a *ValueConfig) fromObject(v interface{}) error {
 	if err := a.Attribute.fromString(attributeStr); err != nil {
 		return err
 	}
+	if transforms, ok := m["transforms"]; ok {
+		transformList, ok := transforms.([]any)
+		if !ok {
+			return errors.New("transforms must be a list")
+		}
+		for _, item := range transformList {
+			transform := TransformConfig{}
+			if err := transform.fromObject(item); err != nil {
+				return err
+			}
+			a.Transforms = append(a.Transforms, transform)
+		}
+	}
 	replacer, ok := m["replacer"]
 	if !ok {
 		return nil
@@ -156,15 +359,201 @@ func (a *ValueConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return a.fromObject(v)
 }
 
+// ElementMatherConfig 元素匹配条件
+// 叶子节点为 attribute + operator + value, 也可以使用 all / any / not 组合其他条件, 例如:
+//
+//	matcher:
+//	  all:
+//	    - attribute: href
+//	      operator: regex
+//	      value: /post/\d+
+//	    - not:
+//	        attribute: class
+//	        operator: contains
+//	        value: ad
 type ElementMatherConfig struct {
-	Attribute    AttributeType `json:"attribute" yaml:"attribute"`
-	OperatorType OperatorType  `json:"operator" yaml:"operator"`
-	Value        string        `json:"value" yaml:"value"`
+	Attribute    AttributeType
+	OperatorType OperatorType
+	Value        string
+	Regex        *regexp.Regexp // operator 为 regex 时编译好的表达式
+	Number       float64        // operator 为数值比较时解析好的数值
+
+	All []*ElementMatherConfig
+	Any []*ElementMatherConfig
+	Not *ElementMatherConfig
+}
+
+func (m *ElementMatherConfig) fromObject(v interface{}) error {
+	mm, ok := v.(map[any]any)
+	if !ok {
+		return errors.New("matcher must be a map")
+	}
+	groupCount := 0
+	if all, ok := mm["all"]; ok {
+		groupCount++
+		list, err := matcherListFromObject(all)
+		if err != nil {
+			return errors.New("invalid all matcher: " + err.Error())
+		}
+		m.All = list
+	}
+	if any, ok := mm["any"]; ok {
+		groupCount++
+		list, err := matcherListFromObject(any)
+		if err != nil {
+			return errors.New("invalid any matcher: " + err.Error())
+		}
+		m.Any = list
+	}
+	if not, ok := mm["not"]; ok {
+		groupCount++
+		m.Not = &ElementMatherConfig{}
+		if err := m.Not.fromObject(not); err != nil {
+			return errors.New("invalid not matcher: " + err.Error())
+		}
+	}
+	_, hasAttribute := mm["attribute"]
+	if groupCount > 1 || (groupCount == 1 && hasAttribute) {
+		return errors.New("matcher can only be one of attribute, all, any or not")
+	}
+	if groupCount == 1 {
+		return nil
+	}
+	attributeStr, ok := mm["attribute"].(string)
+	if !ok {
+		return errors.New("attribute is required and must be a string")
+	}
+	if err := m.Attribute.fromString(attributeStr); err != nil {
+		return err
+	}
+	operatorStr, ok := mm["operator"].(string)
+	if !ok {
+		return errors.New("operator is required and must be a string")
+	}
+	if err := m.OperatorType.fromString(operatorStr); err != nil {
+		return err
+	}
+	if m.OperatorType == OperatorHasAttribute {
+		return nil
+	}
+	value, ok := mm["value"]
+	if !ok {
+		return errors.New("value is required")
+	}
+	m.Value = fmt.Sprint(value)
+	if m.OperatorType == OperatorRegex {
+		regex, err := regexp.Compile(m.Value)
+		if err != nil {
+			return errors.New("invalid regex: " + m.Value + ", error" + err.Error())
+		}
+		m.Regex = regex
+	}
+	if m.OperatorType.IsNumeric() {
+		number, err := strconv.ParseFloat(strings.TrimSpace(m.Value), 64)
+		if err != nil {
+			return errors.New("invalid number: " + m.Value)
+		}
+		m.Number = number
+	}
+	return nil
+}
+func matcherListFromObject(v interface{}) ([]*ElementMatherConfig, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("must be a list")
+	}
+	if len(list) == 0 {
+		return nil, errors.New("list is empty")
+	}
+	result := make([]*ElementMatherConfig, 0, len(list))
+	for _, item := range list {
+		matcher := &ElementMatherConfig{}
+		if err := matcher.fromObject(item); err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+func (m *ElementMatherConfig) UnmmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return m.fromObject(v)
+}
+func (m *ElementMatherConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return m.fromObject(v)
+}
+
+type SelectorType int
+
+const (
+	SelectorTypeCSS SelectorType = iota
+	SelectorTypeXPath
+)
+
+func (t *SelectorType) fromString(s string) error {
+	switch strings.ToLower(s) {
+	case "", "css":
+		*t = SelectorTypeCSS
+	case "xpath":
+		*t = SelectorTypeXPath
+	default:
+		return errors.New("invalid selector type: " + s)
+	}
+	return nil
+}
+func (t *SelectorType) UnmmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return t.fromString(s)
+}
+func (t *SelectorType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return t.fromString(s)
 }
 
 type HTMLParserConfig struct {
 	Selector            string               `json:"selector" yaml:"selector"`
+	SelectorType        SelectorType         `json:"selectorType" yaml:"selectorType"` // css(默认) 或 xpath
 	Value               ValueConfig          `json:"value" yaml:"value"`
 	ElementMatherConfig *ElementMatherConfig `json:"matcher" yaml:"matcher"`
 	Ext                 map[string]string    `json:"ext" yaml:"ext"`
+	XPath               *xpath.Expr          `json:"-" yaml:"-"` // selectorType 为 xpath 时编译好的表达式
+}
+
+func (c *HTMLParserConfig) compile() error {
+	if c.SelectorType != SelectorTypeXPath {
+		return nil
+	}
+	expr, err := xpath.Compile(c.Selector)
+	if err != nil {
+		return errors.New("invalid xpath: " + c.Selector + ", error" + err.Error())
+	}
+	c.XPath = expr
+	return nil
+}
+func (c *HTMLParserConfig) UnmmarshalJSON(data []byte) error {
+	type rawHTMLParserConfig HTMLParserConfig
+	if err := json.Unmarshal(data, (*rawHTMLParserConfig)(c)); err != nil {
+		return err
+	}
+	return c.compile()
+}
+func (c *HTMLParserConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawHTMLParserConfig HTMLParserConfig
+	if err := unmarshal((*rawHTMLParserConfig)(c)); err != nil {
+		return err
+	}
+	return c.compile()
 }
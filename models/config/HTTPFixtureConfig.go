@@ -0,0 +1,7 @@
+package config
+
+// HTTPFixtureConfig 录制/回放 spider 和图片下载的 http 请求, 用于离线测试
+type HTTPFixtureConfig struct {
+	Mode string `json:"mode" yaml:"mode"` // 为空时不启用, record: 录制到 dir 中, replay: 从 dir 中回放
+	Dir  string `json:"dir" yaml:"dir"`
+}
@@ -1,6 +1,25 @@
 package config
 
+const (
+	ConverterBackendImageMagick = "imagemagick"
+	ConverterBackendVips        = "vips"
+	ConverterBackendPassthrough = "passthrough"
+)
+
 type ImageConvertConfig struct {
-	Quality             int  `json:"quality" yaml:"quality"`
-	LosslessModeEnabled bool `json:"losslessModeEnabled" yaml:"losslessModeEnabled"`
+	// 转换使用的工具, imagemagick(默认), vips(libvips 的命令行工具) 或 passthrough(不转换, 直接保存下载的文件)
+	Backend             string `json:"backend" yaml:"backend"`
+	Quality             int    `json:"quality" yaml:"quality"` // 1-100, 为 0 时使用工具的默认值
+	LosslessModeEnabled bool   `json:"losslessModeEnabled" yaml:"losslessModeEnabled"`
+	// 动图的输出格式, webp 或 gif, 默认为 webp
+	AnimatedFormat string      `json:"animatedFormat" yaml:"animatedFormat"`
+	Video          VideoConfig `json:"video" yaml:"video"`
+	// 为空时使用 DefaultRenditions, 动图和视频使用第一帧生成
+	Renditions []RenditionConfig `json:"renditions" yaml:"renditions"`
+}
+
+// VideoConfig 视频的处理方式, 默认直接保存原始文件
+type VideoConfig struct {
+	// 使用 ffmpeg 转换成 h264 的 mp4, 用于兼容不支持 webm 等格式的客户端
+	Transcode bool `json:"transcode" yaml:"transcode"`
 }
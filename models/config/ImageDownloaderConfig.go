@@ -1,8 +1,15 @@
 package config
 
 type ImageDownloaderConfig struct {
-	Headers            map[string]string `json:"headers" yaml:"headers"`
-	ErrorRetryInterval uint              `json:"errorRetryInterval" yaml:"errorRetryInterval"` // in seconds
-	ErrorRetryMaxCount uint              `json:"errorRetryMaxCount" yaml:"errorRetryMaxCount"`
-	ConnectTimeout     int               `json:"connectTimeout" yaml:"connectTimeout"` // in seconds
+	Headers              map[string]string     `json:"headers" yaml:"headers"`
+	ErrorRetryInterval   uint                  `json:"errorRetryInterval" yaml:"errorRetryInterval"` // in seconds
+	ErrorRetryMaxCount   uint                  `json:"errorRetryMaxCount" yaml:"errorRetryMaxCount"`
+	ConnectTimeout       int                   `json:"connectTimeout" yaml:"connectTimeout"` // in seconds
+	Parallelism          int                   `json:"parallelism" yaml:"parallelism"`       // 同时下载的数量, 默认为 1
+	Bandwidth            BandwidthConfig       `json:"bandwidth" yaml:"bandwidth"`           // 这个 source 的下载带宽, 和全局的限制同时生效
+	RetryBackoff         RetryBackoffConfig    `json:"retryBackoff" yaml:"retryBackoff"`
+	WatchedTags          []string              `json:"watchedTags" yaml:"watchedTags"` // 包含这些 tag 的图片优先下载
+	SkipDuplicatePreview PreviewDedupConfig    `json:"skipDuplicatePreview" yaml:"skipDuplicatePreview"`
+	KeepOriginal         bool                  `json:"keepOriginal" yaml:"keepOriginal"` // 转换之后保留原始文件
+	Validation           ImageValidationConfig `json:"validation" yaml:"validation"`
 }
@@ -0,0 +1,8 @@
+package config
+
+// ImageValidationConfig 下载完成之后, 转换之前对图片的检查
+type ImageValidationConfig struct {
+	PlaceholderHashes []string `json:"placeholderHashes" yaml:"placeholderHashes"` // 已知的占位图(例如 "图片已删除")的 sha256, 匹配时认为下载失败
+	MinWidth          int      `json:"minWidth" yaml:"minWidth"`                   // 小于这个尺寸的图片认为无效, 0 表示不限制
+	MinHeight         int      `json:"minHeight" yaml:"minHeight"`
+}
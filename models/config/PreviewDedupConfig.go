@@ -0,0 +1,7 @@
+package config
+
+// PreviewDedupConfig 下载之前先下载预览图, 和已有的图片相似时跳过, 需要配置 MetaParser.PreviewURL
+type PreviewDedupConfig struct {
+	Enabled     bool `json:"enabled" yaml:"enabled"`
+	MaxDistance int  `json:"maxDistance" yaml:"maxDistance"` // dHash 的最大汉明距离
+}
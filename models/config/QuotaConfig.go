@@ -0,0 +1,8 @@
+package config
+
+// QuotaConfig 每个 source 的配额, 为 0 时不限制
+type QuotaConfig struct {
+	MaxPostsPerDay         int64 `json:"maxPostsPerDay" yaml:"maxPostsPerDay"`
+	MaxDownloadBytesPerDay int64 `json:"maxDownloadBytesPerDay" yaml:"maxDownloadBytesPerDay"`
+	MaxDiskBytes           int64 `json:"maxDiskBytes" yaml:"maxDiskBytes"`
+}
@@ -0,0 +1,13 @@
+package config
+
+// RenditionConfig 下载之后额外生成的缩小的图片, 保存为 <文件名>@<name>.<format>
+type RenditionConfig struct {
+	Name      string `json:"name" yaml:"name"`           // 只能包含字母, 数字, - 和 _
+	Format    string `json:"format" yaml:"format"`       // heic, avif, webp 或 jpeg
+	MaxWidth  int    `json:"maxWidth" yaml:"maxWidth"`   // 只缩小不放大, 为 0 时不限制
+	MaxHeight int    `json:"maxHeight" yaml:"maxHeight"` // 只缩小不放大, 为 0 时不限制
+	Quality   int    `json:"quality" yaml:"quality"`     // 为 0 时使用 imageConverter 的 quality
+}
+
+// DefaultRenditions 没有配置时只生成之前版本的 320 宽的缩略图
+var DefaultRenditions = []RenditionConfig{{Name: "320", Format: "heic", MaxWidth: 320}}
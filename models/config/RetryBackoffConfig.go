@@ -0,0 +1,37 @@
+package config
+
+import "time"
+
+// RetryBackoffConfig 下载失败之后的重试间隔, 每次失败间隔翻倍, 直到 MaxInterval
+type RetryBackoffConfig struct {
+	InitialInterval uint `json:"initialInterval" yaml:"initialInterval"` // in seconds, 默认 60
+	MaxInterval     uint `json:"maxInterval" yaml:"maxInterval"`         // in seconds, 默认 86400
+	MaxAttempts     int  `json:"maxAttempts" yaml:"maxAttempts"`         // 失败这么多次之后不再自动重试, 默认 10
+}
+
+func (c RetryBackoffConfig) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return 10
+	}
+	return c.MaxAttempts
+}
+
+// NextRetry 返回第 attempts 次失败之后的重试时间, 超过最大次数时返回 false
+func (c RetryBackoffConfig) NextRetry(now time.Time, attempts int) (time.Time, bool) {
+	if attempts >= c.maxAttempts() {
+		return time.Time{}, false
+	}
+	initial := time.Duration(c.InitialInterval) * time.Second
+	if initial <= 0 {
+		initial = time.Minute
+	}
+	maxInterval := time.Duration(c.MaxInterval) * time.Second
+	if maxInterval <= 0 {
+		maxInterval = 24 * time.Hour
+	}
+	interval := initial
+	for i := 1; i < attempts && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	return now.Add(min(interval, maxInterval)), true
+}
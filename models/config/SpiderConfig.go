@@ -1,11 +1,12 @@
 package config
 
 type MetaDownloaderConfig struct {
-	ErrorRetryInterval             uint `json:"errorRetryInterval" yaml:"errorRetryInterval"` // in seconds
-	ErrorRetryMaxCount             uint `json:"errorRetryMaxCount" yaml:"errorRetryMaxCount"`
-	StateMachineErrorRetryInterval uint `json:"stateMachineErrorRetryInterval" yaml:"stateMachineErrorRetryInterval"` // in seconds
-	RefreshInterval                uint `json:"refreshInterval" yaml:"refreshInterval"`                               // in seconds
-	ConnectTimeout                 int  `json:"connectTimeout" yaml:"connectTimeout"`                                 // in seconds
+	ErrorRetryInterval             uint   `json:"errorRetryInterval" yaml:"errorRetryInterval"` // in seconds
+	ErrorRetryMaxCount             uint   `json:"errorRetryMaxCount" yaml:"errorRetryMaxCount"`
+	StateMachineErrorRetryInterval uint   `json:"stateMachineErrorRetryInterval" yaml:"stateMachineErrorRetryInterval"` // in seconds
+	RefreshInterval                uint   `json:"refreshInterval" yaml:"refreshInterval"`                               // in seconds
+	ConnectTimeout                 int    `json:"connectTimeout" yaml:"connectTimeout"`                                 // in seconds
+	Charset                        string `json:"charset" yaml:"charset"`                                               // 页面编码, 为空时自动检测
 }
 type ListParser struct {
 	URLTemplate     string            `json:"urlTemplate" yaml:"urlTemplate"`
@@ -20,7 +21,16 @@ type MetaParser struct {
 	Headers     map[string]string  `json:"headers" yaml:"headers"`
 	Tags        []HTMLParserConfig `json:"tags" yaml:"tags"`
 	ImageURL    HTMLParserConfig   `json:"imageURL" yaml:"imageURL"`
-	PostTime    HTMLParserConfig   `json:"postTime" yaml:"postTime"`
+	// 按优先级排列的多个版本的图片地址, 配置之后不再使用 ImageURL, 下载失败时依次尝试下一个
+	ImageURLs  []ImageURLParser `json:"imageURLs" yaml:"imageURLs"`
+	PreviewURL HTMLParserConfig `json:"previewURL" yaml:"previewURL"` // 可选
+	PostTime   HTMLParserConfig `json:"postTime" yaml:"postTime"`
+}
+
+// ImageURLParser 一个版本的图片地址, 例如 original / large / sample
+type ImageURLParser struct {
+	Variant string           `json:"variant" yaml:"variant"`
+	Parser  HTMLParserConfig `json:"parser" yaml:"parser"`
 }
 
 type SpiderConfig struct {
@@ -30,4 +40,7 @@ type SpiderConfig struct {
 	ListParser            ListParser            `json:"listParser" yaml:"listParser"`
 	MetaParser            MetaParser            `json:"metaParser" yaml:"metaParser"`
 	ImageDownloaderConfig ImageDownloaderConfig `json:"imageDownloader" yaml:"imageDownloader"`
+	Quota                 QuotaConfig           `json:"quota" yaml:"quota"`
+	// 为空时使用全局的 imageConverter 配置
+	ImageConvertConfig *ImageConvertConfig `json:"imageConverter" yaml:"imageConverter"`
 }
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const spiderTemplateExtendsKey = "extends"
+
+// spiderTemplateResolver 展开 spider 和模板的 extends
+// extends 可以是一个模板名, 也可以是模板名的列表(按顺序合并, 后面的覆盖前面的), 模板本身也可以 extends 其他模板
+// 合并规则: map 递归合并, 其他类型(包括列表)直接覆盖
+type spiderTemplateResolver struct {
+	templates map[string]map[any]any
+	resolved  map[string]map[any]any
+	resolving map[string]bool
+}
+
+func resolveSpiderTemplates(templates map[string]map[any]any, spiders map[string]map[any]any) (map[string]map[any]any, error) {
+	resolver := &spiderTemplateResolver{
+		templates: templates,
+		resolved:  make(map[string]map[any]any),
+		resolving: make(map[string]bool),
+	}
+	result := make(map[string]map[any]any)
+	for id, spider := range spiders {
+		merged, err := resolver.resolve(spider)
+		if err != nil {
+			return nil, fmt.Errorf("resolve spider %s failed: %w", id, err)
+		}
+		result[id] = merged
+	}
+	return result, nil
+}
+func (r *spiderTemplateResolver) template(name string) (map[any]any, error) {
+	if resolved, ok := r.resolved[name]; ok {
+		return resolved, nil
+	}
+	template, ok := r.templates[name]
+	if !ok {
+		return nil, errors.New("template not found: " + name)
+	}
+	if r.resolving[name] {
+		return nil, errors.New("template extends loop: " + name)
+	}
+	r.resolving[name] = true
+	resolved, err := r.resolve(template)
+	delete(r.resolving, name)
+	if err != nil {
+		return nil, fmt.Errorf("resolve template %s failed: %w", name, err)
+	}
+	r.resolved[name] = resolved
+	return resolved, nil
+}
+func (r *spiderTemplateResolver) resolve(node map[any]any) (map[any]any, error) {
+	parents, err := extendsList(node[spiderTemplateExtendsKey])
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[any]any)
+	for _, parent := range parents {
+		template, err := r.template(parent)
+		if err != nil {
+			return nil, err
+		}
+		merged = deepMerge(merged, template)
+	}
+	merged = deepMerge(merged, node)
+	delete(merged, spiderTemplateExtendsKey)
+	return merged, nil
+}
+func extendsList(v any) ([]string, error) {
+	switch extends := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{strings.TrimSpace(extends)}, nil
+	case []any:
+		result := make([]string, 0, len(extends))
+		for _, item := range extends {
+			name, ok := item.(string)
+			if !ok {
+				return nil, errors.New("extends must be a string or a list of string")
+			}
+			result = append(result, strings.TrimSpace(name))
+		}
+		return result, nil
+	default:
+		return nil, errors.New("extends must be a string or a list of string")
+	}
+}
+
+// deepMerge 返回 base 和 override 合并后的新 map, 不修改参数
+func deepMerge(base, override map[any]any) map[any]any {
+	result := make(map[any]any, len(base)+len(override))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range override {
+		overrideMap, ok := v.(map[any]any)
+		if !ok {
+			result[k] = v
+			continue
+		}
+		baseMap, ok := result[k].(map[any]any)
+		if !ok {
+			baseMap = make(map[any]any)
+		}
+		result[k] = deepMerge(baseMap, overrideMap)
+	}
+	return result
+}
+
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainConfig Config
+	if err := unmarshal((*plainConfig)(c)); err != nil {
+		return err
+	}
+	var rawSpiders struct {
+		Spiders map[string]map[any]any `yaml:"spiders"`
+	}
+	if err := unmarshal(&rawSpiders); err != nil {
+		return err
+	}
+	resolved, err := resolveSpiderTemplates(c.SpiderTemplates, rawSpiders.Spiders)
+	if err != nil {
+		return err
+	}
+	c.resolvedSpiders = resolved
+	data, err := yaml.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, &c.Spiders)
+}
+
+// ResolvedSpidersYAML 返回展开模板之后的 spider 配置, 用于检查配置
+func (c *Config) ResolvedSpidersYAML() ([]byte, error) {
+	return yaml.Marshal(map[string]any{"spiders": c.resolvedSpiders})
+}
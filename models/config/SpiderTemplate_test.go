@@ -0,0 +1,239 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func unmarshalSpiderMaps(t *testing.T, data string) map[string]map[any]any {
+	t.Helper()
+	result := make(map[string]map[any]any)
+	if err := yaml.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestResolveSpiderTemplates(t *testing.T) {
+	cases := []struct {
+		name      string
+		templates string
+		spiders   string
+		expected  string
+	}{
+		{
+			name: "nested override",
+			templates: `
+base:
+  metaDownloader:
+    errorRetryMaxCount: 3
+    headers:
+      User-Agent: base
+      Referer: https://example.com
+`,
+			spiders: `
+site:
+  extends: base
+  metaDownloader:
+    errorRetryMaxCount: 5
+    headers:
+      User-Agent: site
+`,
+			expected: `
+site:
+  metaDownloader:
+    errorRetryMaxCount: 5
+    headers:
+      User-Agent: site
+      Referer: https://example.com
+`,
+		},
+		{
+			// 列表不合并, 直接覆盖
+			name: "list replaces list",
+			templates: `
+base:
+  metaParser:
+    tags:
+      - selector: a.tag
+      - selector: a.artist
+`,
+			spiders: `
+site:
+  extends: base
+  metaParser:
+    tags:
+      - selector: span.tag
+`,
+			expected: `
+site:
+  metaParser:
+    tags:
+      - selector: span.tag
+`,
+		},
+		{
+			// 不是 map 的值覆盖 map, map 也覆盖不是 map 的值
+			name: "map and scalar replace each other",
+			templates: `
+base:
+  quota: 10
+  imageConverter:
+    quality: 80
+`,
+			spiders: `
+site:
+  extends: base
+  quota:
+    maxPostsPerDay: 5
+  imageConverter: null
+`,
+			expected: `
+site:
+  quota:
+    maxPostsPerDay: 5
+  imageConverter: null
+`,
+		},
+		{
+			// 按顺序合并, 后面的覆盖前面的, 模板也可以 extends 其他模板
+			name: "extends list and chain",
+			templates: `
+base:
+  name: base
+  metaDownloader:
+    errorRetryMaxCount: 3
+    connectTimeout: 10
+slow:
+  extends: base
+  metaDownloader:
+    connectTimeout: 60
+named:
+  name: named
+`,
+			spiders: `
+site:
+  extends: [slow, named]
+  metaDownloader:
+    errorRetryMaxCount: 1
+`,
+			expected: `
+site:
+  name: named
+  metaDownloader:
+    errorRetryMaxCount: 1
+    connectTimeout: 60
+`,
+		},
+		{
+			name:      "no extends",
+			templates: `{}`,
+			spiders: `
+site:
+  name: site
+`,
+			expected: `
+site:
+  name: site
+`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			templates := unmarshalSpiderMaps(t, c.templates)
+			resolved, err := resolveSpiderTemplates(templates, unmarshalSpiderMaps(t, c.spiders))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := unmarshalSpiderMaps(t, c.expected)
+			if !reflect.DeepEqual(resolved, expected) {
+				t.Fatalf("expected %v, got %v", expected, resolved)
+			}
+			// 合并不能修改模板
+			if !reflect.DeepEqual(templates, unmarshalSpiderMaps(t, c.templates)) {
+				t.Fatalf("templates modified: %v", templates)
+			}
+		})
+	}
+}
+
+func TestResolveSpiderTemplatesError(t *testing.T) {
+	cases := []struct {
+		name      string
+		templates string
+		spiders   string
+		err       string
+	}{
+		{
+			name:      "missing template",
+			templates: `{}`,
+			spiders:   `{site: {extends: base}}`,
+			err:       "template not found: base",
+		},
+		{
+			name:      "missing template in chain",
+			templates: `{base: {extends: missing}}`,
+			spiders:   `{site: {extends: base}}`,
+			err:       "template not found: missing",
+		},
+		{
+			name:      "extends loop",
+			templates: `{a: {extends: b}, b: {extends: a}}`,
+			spiders:   `{site: {extends: a}}`,
+			err:       "template extends loop: a",
+		},
+		{
+			name:      "extends itself",
+			templates: `{a: {extends: [a]}}`,
+			spiders:   `{site: {extends: a}}`,
+			err:       "template extends loop: a",
+		},
+		{
+			name:      "invalid extends",
+			templates: `{}`,
+			spiders:   `{site: {extends: {name: base}}}`,
+			err:       "extends must be a string or a list of string",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := resolveSpiderTemplates(unmarshalSpiderMaps(t, c.templates), unmarshalSpiderMaps(t, c.spiders))
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected error %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigSpiderTemplates(t *testing.T) {
+	data := `
+spiderTemplates:
+  base:
+    metaDownloader:
+      errorRetryMaxCount: 3
+      connectTimeout: 10
+spiders:
+  site:
+    extends: base
+    name: site
+    metaDownloader:
+      connectTimeout: 60
+`
+	appConfig := &Config{}
+	if err := yaml.Unmarshal([]byte(data), appConfig); err != nil {
+		t.Fatal(err)
+	}
+	spider, ok := appConfig.Spiders["site"]
+	if !ok {
+		t.Fatalf("spider not found: %v", appConfig.Spiders)
+	}
+	if spider.ID != "site" || spider.Name != "site" {
+		t.Fatalf("unexpected spider: %s %s", spider.ID, spider.Name)
+	}
+	if spider.MetaDownloaderConfig.ErrorRetryMaxCount != 3 || spider.MetaDownloaderConfig.ConnectTimeout != 60 {
+		t.Fatalf("unexpected meta downloader config: %+v", spider.MetaDownloaderConfig)
+	}
+}
@@ -0,0 +1,24 @@
+package config
+
+const (
+	StorageTypeLocal = "local"
+	StorageTypeS3    = "s3"
+)
+
+// S3StorageConfig S3 兼容的对象存储, 例如 MinIO
+type S3StorageConfig struct {
+	Endpoint       string `json:"endpoint" yaml:"endpoint"` // host:port, 不包含协议
+	Region         string `json:"region" yaml:"region"`
+	Bucket         string `json:"bucket" yaml:"bucket"`
+	AccessKey      string `json:"accessKey" yaml:"accessKey"`
+	SecretKey      string `json:"secretKey" yaml:"secretKey"`
+	UseSSL         bool   `json:"useSSL" yaml:"useSSL"`
+	Prefix         string `json:"prefix" yaml:"prefix"`                 // 所有 key 的前缀
+	PresignExpires uint   `json:"presignExpires" yaml:"presignExpires"` // in seconds, API 重定向的预签名地址的有效期, 默认 3600
+}
+
+// StorageConfig 图片的存储, 默认保存在 ImageDir 中
+type StorageConfig struct {
+	Type string          `json:"type" yaml:"type"` // local(默认) 或 s3
+	S3   S3StorageConfig `json:"s3" yaml:"s3"`
+}
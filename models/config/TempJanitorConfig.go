@@ -0,0 +1,7 @@
+package config
+
+// TempJanitorConfig 定期清理下载临时目录中没有对应的待下载数据的文件
+type TempJanitorConfig struct {
+	Interval int `json:"interval" yaml:"interval"` // in seconds, 默认 3600
+	MaxAge   int `json:"maxAge" yaml:"maxAge"`     // in seconds, 超过这个时间没有修改的文件才会被清理, 默认 86400
+}
@@ -2,22 +2,41 @@ package plugins
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/http"
+	"os"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/util"
 
 	"github.com/gin-gonic/gin"
 	sloggin "github.com/samber/slog-gin"
 )
 
 type API struct {
-	app       interfaces.IApplication
-	router    *gin.Engine
-	server    *http.Server
-	dbService interfaces.IDBService
+	app            interfaces.IApplication
+	router         *gin.Engine
+	server         *http.Server
+	dbService      interfaces.IDBService
+	quotaService   interfaces.IQuotaService
+	downloader     interfaces.IImageDownloaderService
+	storageService interfaces.IStorageService
+	janitor        interfaces.ITempJanitorService
+	converter      interfaces.IImageConvertService
+	resizeConfig   config.ResizeConfig
+	resizeCache    *resizeCache
 }
 
 func newAPI() *API {
@@ -45,6 +64,60 @@ func (s *API) Load(app interfaces.IApplication) error {
 		return err
 	}
 	s.dbService = dbService.(interfaces.IDBService)
+	quotaService, err := app.GetService(s.ID(), QuotaPluginID, interfaces.QuotaServiceID)
+	if err != nil {
+		slog.Error("get quota service failed", "error", err)
+		return err
+	}
+	s.quotaService = quotaService.(interfaces.IQuotaService)
+	downloader, err := app.GetService(s.ID(), ImageDownloaderPluginID, interfaces.ImageDownloaderDownloaderServiceID)
+	if err != nil {
+		slog.Error("get image downloader service failed", "error", err)
+		return err
+	}
+	s.downloader = downloader.(interfaces.IImageDownloaderService)
+	storageService, err := app.GetService(s.ID(), StoragePluginID, interfaces.StorageServiceID)
+	if err != nil {
+		slog.Error("get storage service failed", "error", err)
+		return err
+	}
+	s.storageService = storageService.(interfaces.IStorageService)
+	janitor, err := app.GetService(s.ID(), TempJanitorPluginID, interfaces.TempJanitorServiceID)
+	if err != nil {
+		slog.Error("get temp janitor service failed", "error", err)
+		return err
+	}
+	s.janitor = janitor.(interfaces.ITempJanitorService)
+	converter, err := app.GetService(s.ID(), ImageConvertPluginID, interfaces.ImageConvertServiceID)
+	if err != nil {
+		slog.Error("get image convert service failed", "error", err)
+		return err
+	}
+	s.converter = converter.(interfaces.IImageConvertService)
+	s.resizeConfig = app.GetAppConfig().APIConfig.Resize
+	if len(s.resizeConfig.Formats) == 0 {
+		s.resizeConfig.Formats = []string{"webp", "jpeg"}
+	}
+	for idx, format := range s.resizeConfig.Formats {
+		format = strings.ToLower(format)
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		switch format {
+		case "heic", "avif", "webp", "jpeg", "png":
+		default:
+			return fmt.Errorf("unsupported resize format: %s", format)
+		}
+		s.resizeConfig.Formats[idx] = format
+	}
+	if s.resizeConfig.CacheMaxSize <= 0 {
+		s.resizeConfig.CacheMaxSize = 1024
+	}
+	s.resizeCache, err = newResizeCache(path.Join(app.GetAppConfig().WorkDir, resizeCacheDirName), s.resizeConfig.CacheMaxSize*1024*1024)
+	if err != nil {
+		slog.Error("init resize cache failed", "error", err)
+		return err
+	}
 	s.router = gin.Default()
 	s.router.Use(sloggin.New(slog.Default()))
 	s.server = &http.Server{
@@ -60,7 +133,22 @@ func (s *API) Load(app interfaces.IApplication) error {
 	s.router.GET("/:sourceid/tags", s.listAllTags)
 	s.router.GET("/:sourceid/images", s.listImages)
 	s.router.GET("/:sourceid/image/:id", s.getImage)
-	s.router.Static("/image", s.app.GetAppConfig().ImageDir)
+	s.router.POST("/:sourceid/image/:id/download", s.requestDownload)
+	s.router.GET("/:sourceid/image/:id/file", s.getImageFile)
+	s.router.GET("/:sourceid/image/:id/resize", s.resizeImage)
+	s.router.GET("/:sourceid/quota", s.getQuota)
+	s.router.GET("/:sourceid/duplicates", s.listDuplicates)
+	s.router.GET("/duplicates", s.listDuplicates)
+	s.router.GET("/:sourceid/downloads/failed", s.listDownloadFailures)
+	s.router.POST("/:sourceid/downloads/requeue", s.requeueDownloads)
+	s.router.GET("/downloader/bandwidth", s.getBandwidth)
+	s.router.POST("/downloader/bandwidth", s.setBandwidth)
+	s.router.DELETE("/downloader/bandwidth", s.resetBandwidth)
+	s.router.GET("/downloader/status", s.getDownloaderStatus)
+	s.router.GET("/downloader/janitor", s.getJanitorReport)
+	s.router.POST("/downloader/janitor/sweep", s.sweepTempDir)
+	s.router.GET("/image/*key", s.getStorageFile)
+	s.router.HEAD("/image/*key", s.getStorageFile)
 	return nil
 }
 func (s *API) Unload() {
@@ -118,3 +206,336 @@ func (s *API) getImage(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 }
+
+// getImageFile 返回图片文件, rendition 为 converted(默认, 转换之后的文件), original(保留的原始文件) 或者配置的 rendition 的名字
+func (s *API) getImageFile(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	metaID := c.Param("id")
+	meta, err := s.dbService.GetImageMeta(sourceid, metaID)
+	if _, ok := err.(DBCommonError); ok {
+		c.JSON(http.StatusNotFound, map[string]any{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	var filePath *string
+	switch c.DefaultQuery("rendition", "converted") {
+	case "converted":
+		filePath = meta.LocalPath
+		if filePath != nil {
+			c.Header("Content-Type", util.MediaTypeForExtension(path.Ext(*filePath)))
+		}
+	case "original":
+		filePath = meta.OriginalPath
+		if meta.OriginalMimeType != nil {
+			c.Header("Content-Type", *meta.OriginalMimeType)
+		}
+	default:
+		// 配置的缩小的图片
+		renditionPath, ok := meta.Renditions[c.Query("rendition")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid rendition"})
+			return
+		}
+		filePath = &renditionPath
+		c.Header("Content-Type", util.MediaTypeForExtension(path.Ext(renditionPath)))
+	}
+	if filePath == nil || len(*filePath) == 0 {
+		c.JSON(http.StatusNotFound, map[string]any{"error": "file not found"})
+		return
+	}
+	s.serveStorageFile(c, *filePath)
+}
+func (s *API) getStorageFile(c *gin.Context) {
+	s.serveStorageFile(c, strings.TrimPrefix(c.Param("key"), "/"))
+}
+
+// serveStorageFile 返回存储中的文件, 本地存储直接返回文件, 对象存储重定向到预签名地址
+func (s *API) serveStorageFile(c *gin.Context, key string) {
+	if localPath, ok := s.storageService.LocalPath(key); ok {
+		c.File(localPath)
+		return
+	}
+	expires := time.Duration(s.app.GetAppConfig().Storage.S3.PresignExpires) * time.Second
+	if expires <= 0 {
+		expires = time.Hour
+	}
+	url, ok, err := s.storageService.PresignedURL(key, expires)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	if ok {
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+	object, err := s.storageService.Stat(key)
+	if err == NotFound {
+		c.JSON(http.StatusNotFound, map[string]any{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	reader, err := s.storageService.Get(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	defer reader.Close()
+	c.DataFromReader(http.StatusOK, object.Size, c.Writer.Header().Get("Content-Type"), reader, nil)
+}
+
+// 按需生成的图片的缓存目录, 在 WorkDir 中
+const resizeCacheDirName = "resize_cache"
+
+// resizeImage 返回缩小到 width 宽的 format 格式的图片, 第一次请求时生成并缓存, 只允许配置中的宽度和格式
+func (s *API) resizeImage(c *gin.Context) {
+	width, err := strconv.Atoi(c.Query("width"))
+	if err != nil || !slices.Contains(s.resizeConfig.Widths, width) {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "width not allowed"})
+		return
+	}
+	format := strings.ToLower(c.DefaultQuery("format", s.resizeConfig.Formats[0]))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if !slices.Contains(s.resizeConfig.Formats, format) {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "format not allowed"})
+		return
+	}
+	meta, err := s.dbService.GetImageMeta(c.Param("sourceid"), c.Param("id"))
+	if _, ok := err.(DBCommonError); ok {
+		c.JSON(http.StatusNotFound, map[string]any{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	key := resizeSourceKey(meta)
+	if len(key) == 0 {
+		c.JSON(http.StatusNotFound, map[string]any{"error": "file not found"})
+		return
+	}
+	ext := "." + format
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	// 内容相同的图片共用一个文件, 用文件的路径作为缓存的 key
+	keyHash := md5.Sum([]byte(key))
+	name := hex.EncodeToString(keyHash[:]) + "_" + strconv.Itoa(width) + ext
+	cachedFile, err := s.resizeCache.Get(name, func(output string) error {
+		return s.resize(meta.SourceID, key, output, width)
+	})
+	if errors.Is(err, errConvertNotSupported) {
+		// 配置的 backend 不能缩小图片
+		c.JSON(http.StatusNotImplemented, map[string]any{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	defer cachedFile.Close()
+	stat, err := cachedFile.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Type", util.MediaTypeForExtension(ext))
+	http.ServeContent(c.Writer, c.Request, name, stat.ModTime(), cachedFile)
+}
+
+// resizeSourceKey 用于缩小的文件, 视频使用第一帧生成的 rendition, 有多个时按名字取第一个
+func resizeSourceKey(meta *models.ImageMeta) string {
+	if meta.MediaType != models.MediaTypeVideo {
+		if meta.LocalPath == nil {
+			return ""
+		}
+		return *meta.LocalPath
+	}
+	names := slices.Sorted(maps.Keys(meta.Renditions))
+	if len(names) == 0 {
+		return ""
+	}
+	return meta.Renditions[names[0]]
+}
+
+// resize 对象存储中的文件先下载到临时文件中再转换
+func (s *API) resize(sourceID, key, output string, width int) error {
+	input, ok := s.storageService.LocalPath(key)
+	if !ok {
+		reader, err := s.storageService.Get(key)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		input = output + ".source" + path.Ext(key)
+		defer os.Remove(input)
+		file, err := os.Create(input)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.converter.Resize(sourceID, input, output, width)
+}
+
+// 请求下载时最长的等待时间
+const maxDownloadWait = 5 * time.Minute
+
+// requestDownload 让图片优先下载, wait 为等待下载完成的秒数, 为 0 时不等待
+// 返回图片的信息, 已经下载完成时状态码为 200, 否则为 202
+func (s *API) requestDownload(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	metaID := c.Param("id")
+	wait, err := strconv.ParseInt(c.DefaultQuery("wait", "0"), 10, 32)
+	if err != nil || wait < 0 {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid wait"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), min(time.Duration(wait)*time.Second, maxDownloadWait))
+	defer cancel()
+	err = s.downloader.RequestDownload(ctx, sourceid, metaID, wait > 0)
+	if _, ok := err.(DBCommonError); ok {
+		c.JSON(http.StatusNotFound, map[string]any{"error": err.Error()})
+		return
+	} else if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	meta, err := s.dbService.GetImageMeta(sourceid, metaID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	if meta.DownloadStatus == models.DownloadStatusDone {
+		c.JSON(http.StatusOK, meta)
+	} else {
+		c.JSON(http.StatusAccepted, meta)
+	}
+}
+
+// listDuplicates 列出相似图片的分组, 没有 sourceid 时在所有 source 中查找, distance 为 dHash 的最大汉明距离
+func (s *API) listDuplicates(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	distance, err := strconv.ParseInt(c.DefaultQuery("distance", "4"), 10, 32)
+	if err != nil || distance < 0 || distance > 16 {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid distance"})
+		return
+	}
+	metas, err := s.dbService.ListPerceptualHashes(sourceid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		return
+	}
+	hashes := make([]uint64, len(metas))
+	for idx, meta := range metas {
+		hashes[idx] = uint64(*meta.PerceptualHash)
+	}
+	clusters := make([]models.DuplicateCluster, 0)
+	for _, group := range util.ClusterHashes(hashes, int(distance)) {
+		cluster := models.DuplicateCluster{Images: make([]models.ImageMeta, 0, len(group))}
+		for _, idx := range group {
+			cluster.Images = append(cluster.Images, metas[idx])
+		}
+		clusters = append(clusters, cluster)
+	}
+	c.JSON(http.StatusOK, clusters)
+}
+func (s *API) getQuota(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	if usage, err := s.quotaService.GetUsage(sourceid); err == nil {
+		c.JSON(http.StatusOK, usage)
+	} else if _, ok := err.(DBCommonError); ok {
+		c.JSON(http.StatusNotFound, map[string]any{"error": err.Error()})
+	} else {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+}
+
+// listDownloadFailures 列出下载失败的图片, status 可以是 failed 或 permanently_failed, 为空时返回全部
+func (s *API) listDownloadFailures(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	var offset int64 = 0
+	var limit int64 = 50
+	if v, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 32); err == nil {
+		offset = v
+	}
+	if v, err := strconv.ParseInt(c.DefaultQuery("limit", "50"), 10, 32); err == nil {
+		limit = v
+	}
+	status := models.DownloadStatus(c.Query("status"))
+	if len(status) != 0 && !status.IsFailed() {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid status"})
+		return
+	}
+	if imageList, err := s.dbService.ListDownloadFailures(sourceid, status, offset, limit); err == nil {
+		c.JSON(http.StatusOK, imageList)
+	} else {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+}
+
+// requeueDownloads 把失败的图片重新加入下载队列, 没有指定 id 时处理所有失败的图片
+func (s *API) requeueDownloads(c *gin.Context) {
+	sourceid := c.Param("sourceid")
+	ids := c.QueryArray("id")
+	if count, err := s.dbService.RequeueFailedDownloads(sourceid, ids); err == nil {
+		c.JSON(http.StatusOK, map[string]any{"requeued": count})
+	} else {
+		c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+}
+func (s *API) getDownloaderStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, s.downloader.GetStatus())
+}
+func (s *API) getBandwidth(c *gin.Context) {
+	c.JSON(http.StatusOK, s.downloader.GetBandwidth())
+}
+
+// setBandwidth 临时修改带宽, source 为空时修改全局的限制, rate 为 0 表示不限制
+func (s *API) setBandwidth(c *gin.Context) {
+	sourceid := c.Query("source")
+	rate, err := strconv.ParseInt(c.Query("rate"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid rate"})
+		return
+	}
+	burst, err := strconv.ParseInt(c.DefaultQuery("burst", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": "invalid burst"})
+		return
+	}
+	if err := s.downloader.SetBandwidth(sourceid, rate, burst); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.downloader.GetBandwidth())
+}
+func (s *API) resetBandwidth(c *gin.Context) {
+	if err := s.downloader.ResetBandwidth(c.Query("source")); err != nil {
+		c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.downloader.GetBandwidth())
+}
+
+// getJanitorReport 返回上一次清理下载临时目录的结果
+func (s *API) getJanitorReport(c *gin.Context) {
+	report := s.janitor.LastReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, map[string]any{"error": "not swept yet"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+func (s *API) sweepTempDir(c *gin.Context) {
+	c.JSON(http.StatusOK, s.janitor.Sweep())
+}
@@ -0,0 +1,151 @@
+package plugins
+
+import (
+	"container/list"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 生成中的临时文件的前缀, 启动时删除
+const resizeCacheTempPrefix = "tmp-"
+
+// resizeCache 按需生成的图片的磁盘缓存, 总大小超过 maxSize 时删除最久没有使用的文件
+// 文件的修改时间作为最后使用的时间, 重启之后按修改时间恢复顺序
+type resizeCache struct {
+	dir     string
+	maxSize int64
+	mtx     sync.Mutex
+	size    int64
+	lru     *list.List               // 最近使用的在前面, 元素为 *resizeCacheEntry
+	entries map[string]*list.Element // 用文件名索引
+	pending map[string]chan struct{} // 正在生成的文件, 生成完成时关闭
+}
+
+type resizeCacheEntry struct {
+	name string
+	size int64
+}
+
+func newResizeCache(dir string, maxSize int64) (*resizeCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cache := &resizeCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]chan struct{}),
+	}
+	files := make([]os.FileInfo, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), resizeCacheTempPrefix) {
+			os.Remove(path.Join(dir, dirEntry.Name()))
+			continue
+		}
+		if info, err := dirEntry.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, file := range files {
+		cache.entries[file.Name()] = cache.lru.PushFront(&resizeCacheEntry{name: file.Name(), size: file.Size()})
+		cache.size += file.Size()
+	}
+	cache.mtx.Lock()
+	cache.evict()
+	cache.mtx.Unlock()
+	slog.Info("resize cache loaded", "dir", dir, "files", cache.lru.Len(), "size", cache.size)
+	return cache, nil
+}
+
+// Get 返回缓存的文件, 不存在时调用 generate 生成, 同一个文件同时只会生成一次, 调用者负责关闭
+// 文件在持有 mtx 时打开, 之后被 evict 删除也可以继续读取
+// generate 的参数是临时文件的路径, 扩展名和 name 相同
+func (r *resizeCache) Get(name string, generate func(output string) error) (*os.File, error) {
+	filePath := path.Join(r.dir, name)
+	for {
+		r.mtx.Lock()
+		if element, ok := r.entries[name]; ok {
+			file, err := os.Open(filePath)
+			if err != nil {
+				// 文件被外部删除, 重新生成
+				r.lru.Remove(element)
+				delete(r.entries, name)
+				r.size -= element.Value.(*resizeCacheEntry).size
+				r.mtx.Unlock()
+				slog.Warn("open resize cache failed", "name", name, "error", err)
+				continue
+			}
+			r.lru.MoveToFront(element)
+			r.mtx.Unlock()
+			now := time.Now()
+			os.Chtimes(filePath, now, now)
+			return file, nil
+		}
+		if done, ok := r.pending[name]; ok {
+			r.mtx.Unlock()
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		r.pending[name] = done
+		r.mtx.Unlock()
+		defer func() {
+			r.mtx.Lock()
+			delete(r.pending, name)
+			close(done)
+			r.mtx.Unlock()
+		}()
+		break
+	}
+	tempPath := path.Join(r.dir, resizeCacheTempPrefix+name)
+	defer os.Remove(tempPath)
+	if err := generate(tempPath); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return nil, err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	file, err := os.Open(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		return nil, err
+	}
+	r.entries[name] = r.lru.PushFront(&resizeCacheEntry{name: name, size: stat.Size()})
+	r.size += stat.Size()
+	r.evict()
+	return file, nil
+}
+
+// evict 删除最久没有使用的文件, 至少保留刚刚使用的文件, 需要持有 mtx
+func (r *resizeCache) evict() {
+	for r.size > r.maxSize && r.lru.Len() > 1 {
+		entry := r.lru.Remove(r.lru.Back()).(*resizeCacheEntry)
+		delete(r.entries, entry.name)
+		r.size -= entry.size
+		if err := os.Remove(path.Join(r.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("remove resize cache failed", "name", entry.name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeResizeCacheFile(content string) func(output string) error {
+	return func(output string) error {
+		return os.WriteFile(output, []byte(content), 0644)
+	}
+}
+
+func TestResizeCacheEvictWhileServing(t *testing.T) {
+	cache, err := newResizeCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := cache.Get("a.jpg", writeResizeCacheFile(strings.Repeat("a", 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// 超过大小限制, a.jpg 被删除, 已经打开的文件仍然可以读取
+	second, err := cache.Get("b.jpg", writeResizeCacheFile(strings.Repeat("b", 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, ok := cache.entries["a.jpg"]; ok {
+		t.Fatal("a.jpg should be evicted")
+	}
+	data, err := io.ReadAll(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != strings.Repeat("a", 8) {
+		t.Fatalf("unexpected content: %q", data)
+	}
+
+	// 命中缓存时不再生成
+	third, err := cache.Get("b.jpg", func(output string) error {
+		t.Fatal("cached file generated again")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Close()
+}
+
+func TestResizeCacheRegenerateMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newResizeCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := cache.Get("a.jpg", writeResizeCacheFile("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	file, err = cache.Get("a.jpg", writeResizeCacheFile("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	if string(data) != "new" || cache.size != 3 {
+		t.Fatalf("unexpected content %q, size %d", data, cache.size)
+	}
+}
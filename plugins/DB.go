@@ -1,8 +1,10 @@
 package plugins
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"time"
 	"ywwzwb/imagespider/embed"
 	"ywwzwb/imagespider/interfaces"
 	"ywwzwb/imagespider/models"
@@ -16,9 +18,11 @@ import (
 const DBPluginID string = "DB"
 
 type DB struct {
-	app    interfaces.IApplication
-	config config.DatabaseConfig
-	db     *sql.DB
+	app            interfaces.IApplication
+	config         config.DatabaseConfig
+	db             *sql.DB
+	storageService interfaces.IStorageService
+	similarIndex   *similarImageIndex
 }
 type DBCommonError int
 
@@ -34,6 +38,7 @@ func (e DBCommonError) Error() string {
 }
 func newDB() *DB {
 	DB := DB{}
+	DB.similarIndex = newSimilarImageIndex()
 	return &DB
 }
 
@@ -51,6 +56,13 @@ func (s *DB) ID() string {
 func (s *DB) Load(app interfaces.IApplication) error {
 	s.app = app
 	s.config = app.GetAppConfig().DatabaseConfig
+	// 删除不再被引用的文件
+	storageService, err := app.GetService(s.ID(), StoragePluginID, interfaces.StorageServiceID)
+	if err != nil {
+		slog.Error("get storage service failed", "error", err)
+		return err
+	}
+	s.storageService = storageService.(interfaces.IStorageService)
 	db, err := sql.Open("postgres", s.config.Connection)
 	if err != nil {
 		slog.Error("open database failed", "error", err)
@@ -109,8 +121,14 @@ func (s *DB) GetMeta(id, source string) (*models.ImageMeta, bool) {
 	return &meta, true
 }
 func (s *DB) InsertMeta(meta models.ImageMeta) error {
-	_, err := s.db.Exec("INSERT INTO images (id, source_id, tags, image_url, local_path, post_time) VALUES ($1, $2, $3, $4, $5, $6)",
-		meta.ID, meta.SourceID, pq.Array(meta.Tags), meta.ImageURL, meta.LocalPath, meta.PostTime)
+	candidates, err := marshalImageURLCandidates(meta.ImageURLCandidates)
+	if err != nil {
+		slog.Error("marshal image url candidates failed", "error", err)
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO images (id, source_id, tags, image_url, local_path, post_time, preview_url, image_url_candidates)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		meta.ID, meta.SourceID, pq.Array(meta.Tags), meta.ImageURL, meta.LocalPath, meta.PostTime, meta.PreviewURL, candidates)
 	for tag := range meta.Tags {
 		// 插入 tag 信息
 		s.db.Exec("INSERT INTO tags (tag, source_id, count) VALUES ($1, $2, 0)", tag, meta.SourceID)
@@ -132,23 +150,41 @@ func (s *DB) InsertMeta(meta models.ImageMeta) error {
 		return err
 	}
 	slog.Info("create partition succeed, retry insert", "sql", sql)
-	_, err = s.db.Exec("INSERT INTO images (id, source_id, tags, image_url, local_path, post_time) VALUES ($1, $2, $3, $4, $5, $6)",
-		meta.ID, meta.SourceID, pq.Array(meta.Tags), meta.ImageURL, meta.LocalPath, meta.PostTime)
+	_, err = s.db.Exec(`INSERT INTO images (id, source_id, tags, image_url, local_path, post_time, preview_url, image_url_candidates)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		meta.ID, meta.SourceID, pq.Array(meta.Tags), meta.ImageURL, meta.LocalPath, meta.PostTime, meta.PreviewURL, candidates)
 	if err != nil {
 		slog.Error("insert meta failed", "error", err)
 		return err
 	}
 	return nil
 }
-func (s *DB) GetMetaLocalPathNULL(source string, maxSize int) []models.ImageMeta {
-	// 读取没有本地路径的图片, 最多返回maxSize条数据, 使用post_time 倒序排列
+func (s *DB) UpdateImageURL(meta models.ImageMeta) error {
+	candidates, err := marshalImageURLCandidates(meta.ImageURLCandidates)
+	if err != nil {
+		slog.Error("marshal image url candidates failed", "error", err)
+		return err
+	}
+	_, err = s.db.Exec("UPDATE images SET image_url = $1, image_url_candidates = $2 WHERE id = $3 AND source_id = $4 and post_time=$5",
+		meta.ImageURL, candidates, meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		slog.Error("update image url failed", "error", err)
+	}
+	return err
+}
+func (s *DB) GetMetaToDownload(source string, watchedTags []string, maxSize int) []models.ImageMeta {
+	// 读取等待下载和到了重试时间的图片, 最多返回maxSize条数据
+	// 按照优先级, 是否包含关注的 tag, post_time 倒序排列
 	rows, err := s.db.Query(
-		`SELECT id, tags, image_url, post_time, source_id 
+		`SELECT id, tags, image_url, post_time, source_id, download_status, download_attempts, download_priority, preview_url, image_url_candidates
 			FROM images 
 			WHERE source_id = $1 
-				AND local_path IS NULL
-			ORDER BY post_time 
-			DESC LIMIT $2`, source, maxSize)
+				AND (download_status = 'pending'
+					OR (download_status = 'failed' AND (next_retry_at IS NULL OR next_retry_at <= $2)))
+			ORDER BY download_priority DESC,
+				COALESCE(tags && $3::TEXT[], false) DESC,
+				post_time DESC
+			LIMIT $4`, source, time.Now().UTC(), pq.Array(watchedTags), maxSize)
 	if err != nil {
 		slog.Error("query failed", "error", err)
 		return nil
@@ -157,21 +193,95 @@ func (s *DB) GetMetaLocalPathNULL(source string, maxSize int) []models.ImageMeta
 	var metas []models.ImageMeta
 	for rows.Next() {
 		meta := models.ImageMeta{}
-		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID)
+		var candidates []byte
+		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.DownloadStatus, &meta.DownloadAttempts,
+			&meta.DownloadPriority, &meta.PreviewURL, &candidates)
 		if err != nil {
 			slog.Error("scan failed", "error", err)
 			return nil
 		}
+		if meta.ImageURLCandidates, err = unmarshalImageURLCandidates(candidates); err != nil {
+			slog.Warn("invalid image url candidates, use image url only", "id", meta.ID, "error", err)
+		}
 		metas = append(metas, meta)
 	}
 	return metas
 }
+func (s *DB) CountMetaToDownload(source string) (int64, error) {
+	var count int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM images
+		WHERE source_id = $1
+			AND (download_status = 'pending'
+				OR (download_status = 'failed' AND (next_retry_at IS NULL OR next_retry_at <= $2)))`,
+		source, time.Now().UTC()).Scan(&count)
+	if err != nil {
+		slog.Error("count meta to download failed", "error", err)
+		return 0, err
+	}
+	return count, nil
+}
 func (s *DB) UpdateLocalPathForMeta(meta models.ImageMeta) error {
-	_, err := s.db.Exec("UPDATE images SET local_path = $1 WHERE id = $2 AND source_id = $3 and post_time=$4", meta.LocalPath, meta.ID, meta.SourceID, meta.PostTime)
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("begin transaction failed", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+	renditions, err := marshalRenditions(meta.Renditions)
+	if err != nil {
+		slog.Error("marshal renditions failed", "error", err)
+		return err
+	}
+	var oldContentHash *string
+	err = tx.QueryRow("SELECT content_hash FROM images WHERE id = $1 AND source_id = $2 and post_time=$3 FOR UPDATE",
+		meta.ID, meta.SourceID, meta.PostTime).Scan(&oldContentHash)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("query content hash failed", "error", err)
+		return err
+	}
+	_, err = tx.Exec(`UPDATE images SET local_path = $1, file_size = $2, width = $3, height = $4, download_error = $5, content_hash = $6, phash = $7,
+			original_path = $8, original_size = $9, original_mime_type = $10, media_type = COALESCE(NULLIF($14, ''), media_type),
+			image_variant = $15, renditions = $16,
+			download_status = CASE WHEN $1::TEXT IS NULL THEN 'pending' ELSE 'done' END, next_retry_at = NULL
+		WHERE id = $11 AND source_id = $12 and post_time=$13`,
+		meta.LocalPath, meta.FileSize, meta.Width, meta.Height, meta.DownloadError, meta.ContentHash, meta.PerceptualHash,
+		meta.OriginalPath, meta.OriginalSize, meta.OriginalMimeType,
+		meta.ID, meta.SourceID, meta.PostTime, meta.MediaType, meta.ImageVariant, renditions)
 	if err != nil {
 		slog.Error("update local path failed", "error", err)
 		return err
 	}
+	// 更新 blob 的引用计数
+	var orphanedKeys []string
+	if oldContentHash != nil && (meta.ContentHash == nil || *oldContentHash != *meta.ContentHash) {
+		if orphanedKeys, err = releaseBlob(tx, *oldContentHash); err != nil {
+			return err
+		}
+	}
+	if meta.ContentHash != nil && meta.LocalPath != nil && len(*meta.LocalPath) != 0 && (oldContentHash == nil || *oldContentHash != *meta.ContentHash) {
+		_, err = tx.Exec(`INSERT INTO blobs (content_hash, local_path, file_size, phash, original_path, original_size, original_mime_type, media_type, renditions, ref_count)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE(NULLIF($8, ''), 'image'), $9, 1)
+			ON CONFLICT (content_hash) DO UPDATE SET ref_count = blobs.ref_count + 1`,
+			meta.ContentHash, meta.LocalPath, meta.FileSize, meta.PerceptualHash, meta.OriginalPath, meta.OriginalSize, meta.OriginalMimeType, meta.MediaType, renditions)
+		if err == nil && meta.OriginalPath != nil {
+			// 之前共用这个文件的图片没有保留原始文件
+			_, err = tx.Exec(`UPDATE blobs SET original_path = $2, original_size = $3, original_mime_type = $4, file_size = $5
+				WHERE content_hash = $1 AND original_path IS NULL`,
+				meta.ContentHash, meta.OriginalPath, meta.OriginalSize, meta.OriginalMimeType, meta.FileSize)
+		}
+		if err != nil {
+			slog.Error("add blob reference failed", "error", err)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit failed", "error", err)
+		return err
+	}
+	s.deleteBlobFiles(orphanedKeys)
+	if meta.LocalPath != nil && len(*meta.LocalPath) != 0 && meta.PerceptualHash != nil {
+		s.similarIndex.add(meta.SourceID, meta.ID, uint64(*meta.PerceptualHash))
+	}
 	if meta.LocalPath != nil && len(*meta.LocalPath) != 0 {
 		for tag := range meta.Tags {
 			// 插入 cover 信息
@@ -180,6 +290,423 @@ func (s *DB) UpdateLocalPathForMeta(meta models.ImageMeta) error {
 	}
 	return nil
 }
+
+// releaseBlob 减少 blob 的引用计数, 没有引用时删除记录并返回它的文件(图片, 原始文件和缩略图)
+// 文件需要在事务提交之后通过 deleteBlobFiles 删除
+func releaseBlob(tx *sql.Tx, contentHash string) ([]string, error) {
+	_, err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE content_hash = $1", contentHash)
+	if err != nil {
+		slog.Error("release blob reference failed", "error", err)
+		return nil, err
+	}
+	var localPath string
+	var originalPath *string
+	var renditions []byte
+	err = tx.QueryRow("DELETE FROM blobs WHERE content_hash = $1 AND ref_count <= 0 RETURNING local_path, original_path, renditions", contentHash).
+		Scan(&localPath, &originalPath, &renditions)
+	if err == sql.ErrNoRows {
+		// 还有其他图片引用
+		return nil, nil
+	}
+	if err != nil {
+		slog.Error("delete blob failed", "error", err)
+		return nil, err
+	}
+	keys := []string{localPath}
+	if originalPath != nil && len(*originalPath) != 0 {
+		keys = append(keys, *originalPath)
+	}
+	renditionPaths, err := unmarshalRenditions(renditions)
+	if err != nil {
+		slog.Warn("invalid renditions", "contentHash", contentHash, "error", err)
+	}
+	for _, renditionPath := range renditionPaths {
+		keys = append(keys, renditionPath)
+	}
+	return keys, nil
+}
+
+// releaseMetaBlobs 清空满足 condition 的图片的 content_hash 并释放它们引用的 blob, 返回不再被引用的文件
+// condition 和 args 与调用方之后的 UPDATE 相同, 需要在同一个事务中执行
+func releaseMetaBlobs(tx *sql.Tx, condition string, args ...any) ([]string, error) {
+	rows, err := tx.Query("SELECT content_hash FROM images WHERE content_hash IS NOT NULL AND "+condition+" FOR UPDATE", args...)
+	if err != nil {
+		slog.Error("query content hash failed", "error", err)
+		return nil, err
+	}
+	var contentHashes []string
+	for rows.Next() {
+		var contentHash string
+		if err := rows.Scan(&contentHash); err != nil {
+			rows.Close()
+			slog.Error("scan failed", "error", err)
+			return nil, err
+		}
+		contentHashes = append(contentHashes, contentHash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("query content hash failed", "error", err)
+		return nil, err
+	}
+	if len(contentHashes) == 0 {
+		return nil, nil
+	}
+	if _, err := tx.Exec("UPDATE images SET content_hash = NULL WHERE content_hash IS NOT NULL AND "+condition, args...); err != nil {
+		slog.Error("clear content hash failed", "error", err)
+		return nil, err
+	}
+	var orphanedKeys []string
+	for _, contentHash := range contentHashes {
+		keys, err := releaseBlob(tx, contentHash)
+		if err != nil {
+			return nil, err
+		}
+		orphanedKeys = append(orphanedKeys, keys...)
+	}
+	return orphanedKeys, nil
+}
+
+// deleteBlobFiles 删除 releaseBlob 返回的文件, 删除失败时只记录日志
+func (s *DB) deleteBlobFiles(keys []string) {
+	for _, key := range keys {
+		if err := s.storageService.Delete(key); err != nil {
+			slog.Warn("delete blob file failed", "key", key, "error", err)
+		}
+	}
+}
+func (s *DB) GetBlob(contentHash string) (*models.Blob, error) {
+	blob := models.Blob{}
+	var renditions []byte
+	err := s.db.QueryRow(`SELECT content_hash, local_path, file_size, phash, original_path, original_size, original_mime_type, media_type, renditions, ref_count
+		FROM blobs WHERE content_hash = $1`, contentHash).
+		Scan(&blob.ContentHash, &blob.LocalPath, &blob.FileSize, &blob.PerceptualHash,
+			&blob.OriginalPath, &blob.OriginalSize, &blob.OriginalMimeType, &blob.MediaType, &renditions, &blob.RefCount)
+	if err == sql.ErrNoRows {
+		return nil, NotFound
+	}
+	if err != nil {
+		slog.Error("query blob failed", "error", err)
+		return nil, err
+	}
+	if blob.Renditions, err = unmarshalRenditions(renditions); err != nil {
+		slog.Warn("invalid renditions", "contentHash", contentHash, "error", err)
+	}
+	return &blob, nil
+}
+func (s *DB) UpdateDownloadStatus(meta models.ImageMeta, status models.DownloadStatus) error {
+	_, err := s.db.Exec("UPDATE images SET download_status = $1 WHERE id = $2 AND source_id = $3 and post_time=$4", status, meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		slog.Error("update download status failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// MarkMetaDownloadFailed 记录一次下载失败, nextRetryAt 为空时不再自动重试
+func (s *DB) MarkMetaDownloadFailed(meta models.ImageMeta, reason string, nextRetryAt *time.Time) error {
+	status := models.DownloadStatusPermanentlyFailed
+	if nextRetryAt != nil {
+		status = models.DownloadStatusFailed
+		utc := nextRetryAt.UTC()
+		nextRetryAt = &utc
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("begin transaction failed", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+	// 之前下载成功过时释放引用的文件
+	orphanedKeys, err := releaseMetaBlobs(tx, "id = $1 AND source_id = $2 and post_time=$3", meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE images SET local_path = '', file_size = NULL, download_status = $1, download_attempts = download_attempts + 1,
+			download_error = $2, next_retry_at = $3
+		WHERE id = $4 AND source_id = $5 and post_time=$6`,
+		status, reason, nextRetryAt, meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		slog.Error("mark download failed failed", "error", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit failed", "error", err)
+		return err
+	}
+	s.deleteBlobFiles(orphanedKeys)
+	return nil
+}
+
+// MarkMetaDownloadSkipped 跳过下载, 之后不再自动下载
+func (s *DB) MarkMetaDownloadSkipped(meta models.ImageMeta, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("begin transaction failed", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+	orphanedKeys, err := releaseMetaBlobs(tx, "id = $1 AND source_id = $2 and post_time=$3", meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE images SET local_path = '', download_status = 'skipped', download_error = $1, next_retry_at = NULL
+		WHERE id = $2 AND source_id = $3 and post_time=$4`, reason, meta.ID, meta.SourceID, meta.PostTime)
+	if err != nil {
+		slog.Error("mark download skipped failed", "error", err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit failed", "error", err)
+		return err
+	}
+	s.deleteBlobFiles(orphanedKeys)
+	return nil
+}
+
+// ListPerceptualHashes 返回有 dHash 的已下载的图片, source 为空时返回所有 source 的图片
+func (s *DB) ListPerceptualHashes(source string) ([]models.ImageMeta, error) {
+	rows, err := s.db.Query(`
+		SELECT id, tags, image_url, post_time, source_id, local_path, content_hash, phash
+		FROM images
+		WHERE phash IS NOT NULL
+			AND download_status = 'done'
+			AND ($1 = '' OR source_id = $1)
+		ORDER BY post_time DESC`, source)
+	if err != nil {
+		slog.Error("query failed", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var metas []models.ImageMeta
+	for rows.Next() {
+		var meta models.ImageMeta
+		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.LocalPath, &meta.ContentHash, &meta.PerceptualHash)
+		if err != nil {
+			slog.Error("scan failed", "error", err)
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+func (s *DB) ListDownloadFailures(source string, status models.DownloadStatus, offset, limit int64) (*models.ImageList, error) {
+	// status 为空时返回所有失败的数据
+	rows, err := s.db.Query(`
+		SELECT id, tags, image_url, post_time, source_id, download_status, download_attempts, download_error, next_retry_at, COUNT(*) OVER()
+		FROM images
+		WHERE source_id = $1
+			AND download_status IN ('failed', 'permanently_failed')
+			AND ($2 = '' OR download_status = $2)
+		ORDER BY post_time DESC
+		LIMIT $3 OFFSET $4`, source, status, limit, offset)
+	if err != nil {
+		slog.Error("query failed", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	imageList := &models.ImageList{ImageList: []models.ImageMeta{}}
+	for rows.Next() {
+		var meta models.ImageMeta
+		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID,
+			&meta.DownloadStatus, &meta.DownloadAttempts, &meta.DownloadError, &meta.NextRetryAt, &imageList.TotalCount)
+		if err != nil {
+			slog.Error("scan failed", "error", err)
+			return nil, err
+		}
+		imageList.ImageList = append(imageList.ImageList, meta)
+	}
+	return imageList, nil
+}
+
+// RequeueFailedDownloads 把失败的数据重新加入下载队列, ids 为空时处理这个 source 所有失败的数据, 返回处理的数量
+func (s *DB) RequeueFailedDownloads(source string, ids []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("begin transaction failed", "error", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+	condition := `source_id = $1
+			AND download_status IN ('failed', 'permanently_failed')
+			AND (COALESCE(cardinality($2::TEXT[]), 0) = 0 OR id = ANY($2))`
+	orphanedKeys, err := releaseMetaBlobs(tx, condition, source, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		UPDATE images SET local_path = NULL, download_status = 'pending', download_attempts = 0, download_error = NULL, next_retry_at = NULL
+		WHERE `+condition, source, pq.Array(ids))
+	if err != nil {
+		slog.Error("requeue failed downloads failed", "error", err)
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit failed", "error", err)
+		return 0, err
+	}
+	s.deleteBlobFiles(orphanedKeys)
+	return count, nil
+}
+func (s *DB) FilterPendingDownloadHashes(hashes []string) (map[string]string, error) {
+	rows, err := s.db.Query(`
+		SELECT meta_hash, source_id
+		FROM images
+		WHERE meta_hash = ANY($1)
+			AND download_status IN ('pending', 'downloading', 'failed')`, pq.Array(hashes))
+	if err != nil {
+		slog.Error("query failed", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]string)
+	for rows.Next() {
+		var hash, source string
+		if err := rows.Scan(&hash, &source); err != nil {
+			slog.Error("scan failed", "error", err)
+			return nil, err
+		}
+		result[hash] = source
+	}
+	return result, nil
+}
+func (s *DB) PrioritizeDownload(source, id string, priority int) (models.DownloadStatus, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("begin transaction failed", "error", err)
+		return "", err
+	}
+	defer tx.Rollback()
+	// 重新下载的图片释放之前引用的文件
+	orphanedKeys, err := releaseMetaBlobs(tx, "source_id = $1 AND id = $2 AND download_status IN ('failed', 'permanently_failed', 'skipped')", source, id)
+	if err != nil {
+		return "", err
+	}
+	var status models.DownloadStatus
+	err = tx.QueryRow(`
+		UPDATE images SET download_priority = $1,
+			local_path = CASE WHEN download_status IN ('failed', 'permanently_failed', 'skipped') THEN NULL ELSE local_path END,
+			next_retry_at = CASE WHEN download_status IN ('failed', 'permanently_failed', 'skipped') THEN NULL ELSE next_retry_at END,
+			download_status = CASE WHEN download_status IN ('failed', 'permanently_failed', 'skipped') THEN 'pending' ELSE download_status END
+		WHERE source_id = $2 AND id = $3
+		RETURNING download_status`, priority, source, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", NotFound
+	}
+	if err != nil {
+		slog.Error("update download priority failed", "error", err)
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit failed", "error", err)
+		return "", err
+	}
+	s.deleteBlobFiles(orphanedKeys)
+	return status, nil
+}
+func (s *DB) AddSourceUsage(source string, day time.Time, posts, downloadBytes int64) error {
+	_, err := s.db.Exec(`INSERT INTO source_usage (source_id, day, posts, download_bytes) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (source_id, day) DO UPDATE SET
+			posts = source_usage.posts + EXCLUDED.posts,
+			download_bytes = source_usage.download_bytes + EXCLUDED.download_bytes`,
+		source, day.Format(time.DateOnly), posts, downloadBytes)
+	if err != nil {
+		slog.Error("add source usage failed", "error", err)
+		return err
+	}
+	return nil
+}
+func (s *DB) GetSourceUsage(source string, day time.Time) (posts, downloadBytes int64, err error) {
+	err = s.db.QueryRow("SELECT posts, download_bytes FROM source_usage WHERE source_id = $1 AND day = $2", source, day.Format(time.DateOnly)).Scan(&posts, &downloadBytes)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	if err != nil {
+		slog.Error("query source usage failed", "error", err)
+	}
+	return
+}
+func (s *DB) GetSourceDiskUsage(source string) (int64, error) {
+	var diskBytes, unknownCount, averageSize int64
+	// 同一个 source 中内容相同的图片共用一个文件, 只计算一次
+	// 之前的版本没有记录文件大小, 在 DataChecker 补上之前按平均大小估算
+	err := s.db.QueryRow(`WITH files AS (
+			SELECT DISTINCT ON (COALESCE(content_hash, local_path)) file_size FROM images
+			WHERE source_id = $1 AND local_path IS NOT NULL AND local_path != ''
+		)
+		SELECT COALESCE(SUM(file_size), 0), COUNT(*) FILTER (WHERE file_size IS NULL), COALESCE(AVG(file_size), 0)::BIGINT FROM files`,
+		source).Scan(&diskBytes, &unknownCount, &averageSize)
+	if err != nil {
+		slog.Error("query source disk usage failed", "error", err)
+		return 0, err
+	}
+	if unknownCount > 0 {
+		slog.Debug("estimate size of files without file size", "source", source, "count", unknownCount, "averageSize", averageSize)
+	}
+	return diskBytes + unknownCount*averageSize, nil
+}
+
+// ListMetaWithoutFileSize 返回已经下载但是没有记录文件大小的数据, 用于补上文件大小
+func (s *DB) ListMetaWithoutFileSize(source string, offset, limit int64) ([]models.ImageMeta, error) {
+	rows, err := s.db.Query(`SELECT id, source_id, post_time, local_path, content_hash, renditions FROM images
+		WHERE source_id = $1 AND local_path IS NOT NULL AND local_path != '' AND file_size IS NULL
+		ORDER BY post_time DESC
+		LIMIT $2 OFFSET $3`, source, limit, offset)
+	if err != nil {
+		slog.Error("query meta without file size failed", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	metas := make([]models.ImageMeta, 0)
+	for rows.Next() {
+		meta := models.ImageMeta{}
+		var renditions []byte
+		if err := rows.Scan(&meta.ID, &meta.SourceID, &meta.PostTime, &meta.LocalPath, &meta.ContentHash, &renditions); err != nil {
+			slog.Error("scan failed", "error", err)
+			return nil, err
+		}
+		if meta.Renditions, err = unmarshalRenditions(renditions); err != nil {
+			slog.Warn("invalid renditions", "id", meta.ID, "error", err)
+		}
+		metas = append(metas, meta)
+	}
+	return metas, rows.Err()
+}
+
+// UpdateFileSize 补上文件大小, 共用的 blob 没有记录大小时一起更新
+func (s *DB) UpdateFileSize(meta models.ImageMeta) error {
+	_, err := s.db.Exec("UPDATE images SET file_size = $1 WHERE id = $2 AND source_id = $3 AND post_time = $4 AND file_size IS NULL",
+		meta.FileSize, meta.ID, meta.SourceID, meta.PostTime)
+	if err == nil && meta.ContentHash != nil {
+		_, err = s.db.Exec("UPDATE blobs SET file_size = $1 WHERE content_hash = $2 AND file_size IS NULL", meta.FileSize, meta.ContentHash)
+	}
+	if err != nil {
+		slog.Error("update file size failed", "error", err)
+	}
+	return err
+}
+
+// UpdateRenditions 更新缩小的图片, 共用同一个文件的 blob 一起更新
+func (s *DB) UpdateRenditions(meta models.ImageMeta) error {
+	renditions, err := marshalRenditions(meta.Renditions)
+	if err != nil {
+		slog.Error("marshal renditions failed", "error", err)
+		return err
+	}
+	_, err = s.db.Exec("UPDATE images SET renditions = $1 WHERE id = $2 AND source_id = $3 AND post_time = $4",
+		renditions, meta.ID, meta.SourceID, meta.PostTime)
+	if err == nil && meta.LocalPath != nil {
+		_, err = s.db.Exec("UPDATE blobs SET renditions = $1 WHERE local_path = $2", renditions, meta.LocalPath)
+	}
+	if err != nil {
+		slog.Error("update renditions failed", "error", err)
+	}
+	return err
+}
 func (s *DB) GetService(serviceID interfaces.ServiceID) (interfaces.IService, error) {
 	switch serviceID {
 	case interfaces.DBServiceID:
@@ -272,7 +799,7 @@ func (s *DB) ListDownloadedImageOfTags(source string, tags []string, offset, lim
 	var err error
 	if len(tags) == 0 {
 		rows, err = s.db.Query(`WITH filtered_images AS (
-			SELECT id, tags, image_url, post_time, source_id, local_path
+			SELECT id, tags, image_url, post_time, source_id, local_path, media_type, renditions
 			FROM images
 			WHERE source_id = $1
 			AND local_path IS NOT NULL
@@ -281,14 +808,14 @@ func (s *DB) ListDownloadedImageOfTags(source string, tags []string, offset, lim
 			SELECT COUNT(*) AS total_items
 			FROM filtered_images
 		)
-		SELECT i.id, i.tags, i.image_url, i.post_time, i.source_id, i.local_path, t.total_items
+		SELECT i.id, i.tags, i.image_url, i.post_time, i.source_id, i.local_path, i.media_type, i.renditions, t.total_items
 		FROM filtered_images i
 		CROSS JOIN total_count t
 		ORDER BY i.post_time DESC
 		LIMIT $2 OFFSET $3;`, source, limit, offset)
 	} else {
 		rows, err = s.db.Query(`WITH filtered_images AS (
-			SELECT id, tags, image_url, post_time, source_id, local_path
+			SELECT id, tags, image_url, post_time, source_id, local_path, media_type, renditions
 			FROM images
 			WHERE source_id = $1
 			AND local_path IS NOT NULL
@@ -298,7 +825,7 @@ func (s *DB) ListDownloadedImageOfTags(source string, tags []string, offset, lim
 			SELECT COUNT(*) AS total_items
 			FROM filtered_images
 		)
-		SELECT i.id, i.tags, i.image_url, i.post_time, i.source_id, i.local_path, t.total_items
+		SELECT i.id, i.tags, i.image_url, i.post_time, i.source_id, i.local_path, i.media_type, i.renditions, t.total_items
 		FROM filtered_images i
 		CROSS JOIN total_count t
 		ORDER BY i.post_time DESC
@@ -315,19 +842,25 @@ func (s *DB) ListDownloadedImageOfTags(source string, tags []string, offset, lim
 	}
 	for rows.Next() {
 		meta := models.ImageMeta{}
-		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.LocalPath, &imageList.TotalCount)
+		var renditions []byte
+		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.LocalPath, &meta.MediaType, &renditions,
+			&imageList.TotalCount)
 		if err != nil {
 			slog.Error("scan failed", "error", err)
 			return nil, err
 		}
+		if meta.Renditions, err = unmarshalRenditions(renditions); err != nil {
+			slog.Warn("invalid renditions", "id", meta.ID, "error", err)
+		}
 		imageList.ImageList = append(imageList.ImageList, meta)
 	}
 	return imageList, nil
 }
 func (s *DB) GetImageMeta(source string, id string) (*models.ImageMeta, error) {
 	rows, err := s.db.Query(`
-	SELECT id, tags, image_url, post_time, source_id, local_path
-	images
+	SELECT id, tags, image_url, post_time, source_id, local_path, width, height, download_status, download_attempts, download_error, next_retry_at,
+		original_path, original_size, original_mime_type, media_type, image_url_candidates, image_variant, renditions
+	FROM images
 	WHERE source_id = $1
 	AND id = $2;`, source, id)
 	if err != nil {
@@ -337,12 +870,67 @@ func (s *DB) GetImageMeta(source string, id string) (*models.ImageMeta, error) {
 	defer rows.Close()
 	if rows.Next() {
 		var meta models.ImageMeta
-		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.LocalPath)
+		var candidates, renditions []byte
+		err = rows.Scan(&meta.ID, pq.Array(&meta.Tags), &meta.ImageURL, &meta.PostTime, &meta.SourceID, &meta.LocalPath, &meta.Width, &meta.Height,
+			&meta.DownloadStatus, &meta.DownloadAttempts, &meta.DownloadError, &meta.NextRetryAt,
+			&meta.OriginalPath, &meta.OriginalSize, &meta.OriginalMimeType, &meta.MediaType, &candidates, &meta.ImageVariant, &renditions)
 		if err != nil {
 			slog.Error("scan failed", "error", err)
 			return nil, err
 		}
+		if meta.ImageURLCandidates, err = unmarshalImageURLCandidates(candidates); err != nil {
+			slog.Warn("invalid image url candidates", "id", meta.ID, "error", err)
+		}
+		if meta.Renditions, err = unmarshalRenditions(renditions); err != nil {
+			slog.Warn("invalid renditions", "id", meta.ID, "error", err)
+		}
 		return &meta, nil
 	}
 	return nil, NotFound
 }
+
+// marshalImageURLCandidates 转换成 jsonb 保存, 没有多个版本时保存 NULL
+func marshalImageURLCandidates(candidates []models.ImageURLCandidate) (*string, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(candidates)
+	if err != nil {
+		return nil, err
+	}
+	value := string(data)
+	return &value, nil
+}
+func unmarshalImageURLCandidates(data []byte) ([]models.ImageURLCandidate, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var candidates []models.ImageURLCandidate
+	if err := json.Unmarshal(data, &candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// marshalRenditions 转换成 jsonb 保存, 没有 rendition 时保存 NULL
+func marshalRenditions(renditions map[string]string) (*string, error) {
+	if len(renditions) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(renditions)
+	if err != nil {
+		return nil, err
+	}
+	value := string(data)
+	return &value, nil
+}
+func unmarshalRenditions(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var renditions map[string]string
+	if err := json.Unmarshal(data, &renditions); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
@@ -0,0 +1,86 @@
+package plugins
+
+import (
+	"database/sql"
+	"log/slog"
+	"sync"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/util"
+)
+
+// similarImageKey 索引中的一张图片
+type similarImageKey struct {
+	sourceID string
+	id       string
+}
+
+// similarImageIndex 已下载的图片的 dHash 的内存索引, 第一次查找时从数据库加载, 之后保存新下载的图片时添加
+// 图片删除或者重新下载之后索引中的数据可能已经过期, 查找到之后在数据库中确认, 过期的数据从索引中删除
+type similarImageIndex struct {
+	mtx    sync.Mutex
+	loaded bool
+	tree   *util.BKTree[similarImageKey]
+}
+
+func newSimilarImageIndex() *similarImageIndex {
+	return &similarImageIndex{tree: util.NewBKTree[similarImageKey]()}
+}
+func (i *similarImageIndex) add(sourceID, id string, phash uint64) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if !i.loaded {
+		// 加载时会读取到
+		return
+	}
+	i.tree.Add(phash, similarImageKey{sourceID: sourceID, id: id})
+}
+func (i *similarImageIndex) remove(sourceID, id string, phash uint64) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.tree.Remove(phash, similarImageKey{sourceID: sourceID, id: id})
+}
+
+// search 返回距离不超过 maxDistance 的图片, 距离近的在前面, 没有加载时先从数据库加载
+func (i *similarImageIndex) search(s *DB, phash uint64, maxDistance int) ([]util.BKTreeMatch[similarImageKey], error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if !i.loaded {
+		metas, err := s.ListPerceptualHashes("")
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range metas {
+			i.tree.Add(uint64(*meta.PerceptualHash), similarImageKey{sourceID: meta.SourceID, id: meta.ID})
+		}
+		i.loaded = true
+		slog.Info("perceptual hash index loaded", "count", i.tree.Len())
+	}
+	return i.tree.Search(phash, maxDistance), nil
+}
+
+// FindSimilarImage 查找 dHash 距离不超过 maxDistance 的已下载的图片, 有多个时返回距离最近的
+func (s *DB) FindSimilarImage(phash int64, maxDistance int) (*models.ImageMeta, error) {
+	matches, err := s.similarIndex.search(s, uint64(phash), maxDistance)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		var meta models.ImageMeta
+		err := s.db.QueryRow(`
+			SELECT id, source_id, post_time, local_path, phash
+			FROM images
+			WHERE source_id = $1 AND id = $2 AND phash = $3 AND download_status = 'done'`,
+			match.Value.sourceID, match.Value.id, int64(match.Hash)).Scan(&meta.ID, &meta.SourceID, &meta.PostTime, &meta.LocalPath, &meta.PerceptualHash)
+		if err == sql.ErrNoRows {
+			// 已经删除或者重新下载了
+			s.similarIndex.remove(match.Value.sourceID, match.Value.id, match.Hash)
+			continue
+		}
+		if err != nil {
+			slog.Error("query similar image failed", "error", err)
+			return nil, err
+		}
+		return &meta, nil
+	}
+	return nil, NotFound
+}
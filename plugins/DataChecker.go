@@ -3,11 +3,10 @@ package plugins
 import (
 	"fmt"
 	"log/slog"
-	"os"
-	"path"
 	"sync/atomic"
 	"time"
 	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
 )
 
 const DataCheckerPluginID string = "DataChecker"
@@ -17,6 +16,8 @@ type DataChecker struct {
 	stopChain       chan bool
 	stopFinishChain chan bool
 	dbService       interfaces.IDBService
+	storageService  interfaces.IStorageService
+	quotaService    interfaces.IQuotaService
 	goroutinCount   atomic.Int32
 }
 
@@ -49,6 +50,18 @@ func (d *DataChecker) Load(app interfaces.IApplication) error {
 		return err
 	}
 	d.dbService = dbService.(interfaces.IDBService)
+	storageService, err := app.GetService(d.ID(), StoragePluginID, interfaces.StorageServiceID)
+	if err != nil {
+		slog.Error("get storage service failed", "error", err)
+		return err
+	}
+	d.storageService = storageService.(interfaces.IStorageService)
+	quotaService, err := app.GetService(d.ID(), QuotaPluginID, interfaces.QuotaServiceID)
+	if err != nil {
+		slog.Error("get quota service failed", "error", err)
+		return err
+	}
+	d.quotaService = quotaService.(interfaces.IQuotaService)
 	return nil
 }
 
@@ -76,6 +89,8 @@ func (d *DataChecker) checkData(sourceID string) {
 	for {
 		offset := 0
 		hasBadMeta := false
+		// 删除了数据或者补上了文件大小, 需要重新计算占用的空间
+		diskUsageChanged := false
 		for {
 			select {
 			case <-d.stopChain:
@@ -88,12 +103,18 @@ func (d *DataChecker) checkData(sourceID string) {
 				break
 			}
 			for _, meta := range metas.ImageList {
-				path := path.Join(d.app.GetAppConfig().ImageDir, *meta.LocalPath)
-				if _, err := os.Stat(path); err != nil {
+				_, err := d.storageService.Stat(*meta.LocalPath)
+				if err == NotFound {
 					hasBadMeta = true
-					slog.Error("image not found", "id", meta.ID, "path", path, "error", err)
+					diskUsageChanged = true
+					slog.Error("image not found", "id", meta.ID, "path", *meta.LocalPath)
 					meta.LocalPath = nil
 					d.dbService.UpdateLocalPathForMeta(meta)
+				} else if err != nil {
+					// 存储暂时不可用, 不能确定文件是否存在
+					slog.Warn("stat image failed", "id", meta.ID, "path", *meta.LocalPath, "error", err)
+				} else {
+					d.removeMissingRenditions(meta)
 				}
 			}
 			if hasBadMeta {
@@ -119,6 +140,14 @@ func (d *DataChecker) checkData(sourceID string) {
 				continue
 			}
 		}
+		if updated, stopped := d.backfillFileSize(sourceID); stopped {
+			goto exit
+		} else if updated > 0 {
+			diskUsageChanged = true
+		}
+		if diskUsageChanged {
+			d.quotaService.RefreshDiskUsage(sourceID)
+		}
 		select {
 		case <-d.stopChain:
 			goto exit
@@ -129,3 +158,61 @@ func (d *DataChecker) checkData(sourceID string) {
 exit:
 	d.stopFinishChain <- true
 }
+
+// removeMissingRenditions 删除文件不存在的 rendition, 例如之前的版本补上的 @320.heic
+func (d *DataChecker) removeMissingRenditions(meta models.ImageMeta) {
+	removed := false
+	for name, rendition := range meta.Renditions {
+		if _, err := d.storageService.Stat(rendition); err == NotFound {
+			slog.Warn("rendition not found", "id", meta.ID, "rendition", name, "path", rendition)
+			delete(meta.Renditions, name)
+			removed = true
+		}
+	}
+	if removed {
+		d.dbService.UpdateRenditions(meta)
+	}
+}
+
+// backfillFileSize 补上之前的版本没有记录的文件大小(包括 rendition), 返回补上的数量, 收到停止信号时 stopped 为 true
+func (d *DataChecker) backfillFileSize(sourceID string) (updated int, stopped bool) {
+	batchSize := d.app.GetAppConfig().DataCheckerConfig.BatchSize
+	offset := 0
+	for {
+		metas, err := d.dbService.ListMetaWithoutFileSize(sourceID, int64(offset), int64(batchSize))
+		if err != nil {
+			return
+		}
+		for _, meta := range metas {
+			object, err := d.storageService.Stat(*meta.LocalPath)
+			if err != nil {
+				// 文件不存在的数据由检查处理, 这里跳过
+				offset++
+				continue
+			}
+			fileSize := object.Size
+			for _, rendition := range meta.Renditions {
+				if object, err := d.storageService.Stat(rendition); err == nil {
+					fileSize += object.Size
+				}
+			}
+			meta.FileSize = &fileSize
+			if err := d.dbService.UpdateFileSize(meta); err != nil {
+				offset++
+				continue
+			}
+			updated++
+		}
+		if len(metas) == 0 || len(metas) < batchSize {
+			if updated > 0 {
+				slog.Info("backfill file size finish", "sourceID", sourceID, "updated", updated)
+			}
+			return
+		}
+		select {
+		case <-d.stopChain:
+			return updated, true
+		case <-time.After(time.Duration(d.app.GetAppConfig().DataCheckerConfig.Interval) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package plugins
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/models/runtimeConfig"
+	"ywwzwb/imagespider/util"
+)
+
+// 测试使用的录制的请求, 由 httpFixture 的 record 模式录制, 每个目录对应一个测试的网站
+const fixtureSourceID = "fixture"
+
+// useHTTPFixture 回放 testdata/fixtures/<name> 中的请求, 测试结束时关闭
+func useHTTPFixture(t *testing.T, name string) {
+	t.Helper()
+	err := util.InitHTTPFixture(config.HTTPFixtureConfig{
+		Mode: util.HTTPFixtureModeReplay,
+		Dir:  filepath.Join("testdata", "fixtures", name),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(util.CloseHTTPFixture)
+}
+
+type fakeApplication struct {
+	interfaces.IApplication
+	appConfig     *config.Config
+	runtimeConfig *runtimeConfig.Config
+}
+
+func newFakeApplication(t *testing.T) *fakeApplication {
+	workDir := t.TempDir()
+	return &fakeApplication{
+		appConfig:     &config.Config{WorkDir: workDir},
+		runtimeConfig: runtimeConfig.NewConfigFromPath(filepath.Join(workDir, "runtime.yaml")),
+	}
+}
+func (a *fakeApplication) GetAppConfig() *config.Config {
+	return a.appConfig
+}
+func (a *fakeApplication) GetRuntimeConfig() *runtimeConfig.Config {
+	return a.runtimeConfig
+}
+
+// fakeDBService 在内存中保存 meta, 只实现 spider 和下载用到的方法
+type fakeDBService struct {
+	interfaces.IDBService
+	mtx      sync.Mutex
+	metas    map[string]models.ImageMeta
+	inserted []string
+	statuses map[string]models.DownloadStatus
+	failures map[string]string
+}
+
+func newFakeDBService(existingIDs ...string) *fakeDBService {
+	db := &fakeDBService{
+		metas:    make(map[string]models.ImageMeta),
+		statuses: make(map[string]models.DownloadStatus),
+		failures: make(map[string]string),
+	}
+	for _, id := range existingIDs {
+		db.metas[id] = models.ImageMeta{SourceID: fixtureSourceID, ID: id}
+	}
+	return db
+}
+func (d *fakeDBService) GetMeta(id, source string) (*models.ImageMeta, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	meta, ok := d.metas[id]
+	return &meta, ok
+}
+func (d *fakeDBService) InsertMeta(meta models.ImageMeta) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.metas[meta.ID]; ok {
+		return errors.New("duplicated meta: " + meta.ID)
+	}
+	d.metas[meta.ID] = meta
+	d.inserted = append(d.inserted, meta.ID)
+	return nil
+}
+func (d *fakeDBService) UpdateImageURL(meta models.ImageMeta) error {
+	return nil
+}
+func (d *fakeDBService) UpdateDownloadStatus(meta models.ImageMeta, status models.DownloadStatus) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.statuses[meta.ID] = status
+	return nil
+}
+func (d *fakeDBService) UpdateLocalPathForMeta(meta models.ImageMeta) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.metas[meta.ID] = meta
+	d.statuses[meta.ID] = models.DownloadStatusDone
+	return nil
+}
+func (d *fakeDBService) GetBlob(contentHash string) (*models.Blob, error) {
+	return nil, NotFound
+}
+func (d *fakeDBService) MarkMetaDownloadFailed(meta models.ImageMeta, reason string, nextRetryAt *time.Time) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.statuses[meta.ID] = models.DownloadStatusFailed
+	d.failures[meta.ID] = reason
+	return nil
+}
+func (d *fakeDBService) MarkMetaDownloadSkipped(meta models.ImageMeta, reason string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.statuses[meta.ID] = models.DownloadStatusSkipped
+	return nil
+}
+
+// fakeQuotaService 不限制数量, maxPosts 大于 0 时限制新数据的数量
+type fakeQuotaService struct {
+	interfaces.IQuotaService
+	mtx           sync.Mutex
+	maxPosts      int
+	posts         int
+	downloadBytes int64
+	diskBytes     int64
+}
+
+func (q *fakeQuotaService) AllowNewPost(sourceID string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.maxPosts <= 0 || q.posts < q.maxPosts
+}
+func (q *fakeQuotaService) AddPost(sourceID string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.posts++
+}
+func (q *fakeQuotaService) AddDownloadBytes(sourceID string, size int64) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.downloadBytes += size
+}
+func (q *fakeQuotaService) AddDiskBytes(sourceID string, size int64) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.diskBytes += size
+}
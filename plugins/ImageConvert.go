@@ -2,20 +2,105 @@ package plugins
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"slices"
 	"strings"
 	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
 	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/util"
 )
 
 const ImageConvertPluginID string = "ImageConvert"
 
+// converterOutputFormats 启动时检查 backend 是否支持的输出格式
+var converterOutputFormats = []string{"heic", "avif", "webp", "jpeg", "png", "gif"}
+
 type ImageConvert struct {
-	app    interfaces.IApplication
-	config config.ImageConvertConfig
+	app interfaces.IApplication
+	// 按 source 区分的配置, key 为空的是全局配置
+	converters map[string]*sourceConverter
+}
+
+// sourceConverter 一个 source 使用的转换配置和 backend
+type sourceConverter struct {
+	config  config.ImageConvertConfig
+	backend converterBackend
+}
+
+func newSourceConverter(convertConfig config.ImageConvertConfig) (*sourceConverter, error) {
+	convertConfig.AnimatedFormat = strings.ToLower(convertConfig.AnimatedFormat)
+	switch convertConfig.AnimatedFormat {
+	case "webp", "gif":
+	case "":
+		convertConfig.AnimatedFormat = "webp"
+	default:
+		slog.Warn("unsupported animated format, use webp", "format", convertConfig.AnimatedFormat)
+		convertConfig.AnimatedFormat = "webp"
+	}
+	renditions, err := normalizeRenditions(convertConfig.Renditions)
+	if err != nil {
+		return nil, err
+	}
+	convertConfig.Renditions = renditions
+	backend, err := newConverterBackend(&convertConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceConverter{config: convertConfig, backend: backend}, nil
+}
+
+var renditionNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// normalizeRenditions 检查 rendition 的配置, 格式统一为小写, jpg 转换成 jpeg
+func normalizeRenditions(renditions []config.RenditionConfig) ([]config.RenditionConfig, error) {
+	if len(renditions) == 0 {
+		renditions = config.DefaultRenditions
+	}
+	renditions = slices.Clone(renditions)
+	names := make(map[string]struct{})
+	for idx := range renditions {
+		rendition := &renditions[idx]
+		if !renditionNameRegex.MatchString(rendition.Name) {
+			return nil, fmt.Errorf("invalid rendition name: %q", rendition.Name)
+		}
+		if _, ok := names[rendition.Name]; ok {
+			return nil, fmt.Errorf("duplicate rendition name: %s", rendition.Name)
+		}
+		names[rendition.Name] = struct{}{}
+		rendition.Format = strings.ToLower(rendition.Format)
+		if rendition.Format == "jpg" {
+			rendition.Format = "jpeg"
+		}
+		switch rendition.Format {
+		case "heic", "avif", "webp", "jpeg":
+		default:
+			return nil, fmt.Errorf("unsupported format of rendition %s: %s", rendition.Name, rendition.Format)
+		}
+		if rendition.MaxWidth < 0 || rendition.MaxHeight < 0 || rendition.Quality < 0 || rendition.Quality > 100 {
+			return nil, fmt.Errorf("invalid size or quality of rendition %s", rendition.Name)
+		}
+	}
+	return renditions, nil
+}
+
+// renditionSuffix rendition 的文件名后缀, 例如 @320.heic
+func renditionSuffix(rendition config.RenditionConfig) string {
+	ext := "." + rendition.Format
+	if rendition.Format == "jpeg" {
+		ext = ".jpg"
+	}
+	return "@" + rendition.Name + ext
+}
+
+// canResize passthrough 不能生成缩略图
+func (c *sourceConverter) canResize() bool {
+	return c.backend.Name() != config.ConverterBackendPassthrough
 }
 
 func newImageConverter() *ImageConvert {
@@ -36,14 +121,57 @@ func (i *ImageConvert) ID() string {
 }
 func (i *ImageConvert) Load(app interfaces.IApplication) error {
 	i.app = app
-	i.config = app.GetAppConfig().ImageConvertConfig
-	// 创建临时目录用于下载
-	if err := os.MkdirAll(app.GetAppConfig().ImageDir, 0755); err != nil {
-		slog.Error("create image dir failed", "path", app.GetAppConfig().ImageDir, "error", err)
+	defaultConverter, err := newSourceConverter(app.GetAppConfig().ImageConvertConfig)
+	if err != nil {
+		slog.Error("init image converter failed", "error", err)
 		return err
 	}
+	i.converters = map[string]*sourceConverter{"": defaultConverter}
+	for sourceID, spiderConfig := range app.GetAppConfig().Spiders {
+		if spiderConfig.ImageConvertConfig == nil {
+			continue
+		}
+		converter, err := newSourceConverter(*spiderConfig.ImageConvertConfig)
+		if err != nil {
+			slog.Error("init image converter failed", "sourceID", sourceID, "error", err)
+			return err
+		}
+		i.converters[sourceID] = converter
+	}
+	i.probeBackends()
 	return nil
 }
+
+// probeBackends 记录每个 backend 的版本和支持的格式, 缺少需要的格式时只输出警告, 转换时才会失败
+func (i *ImageConvert) probeBackends() {
+	probed := make(map[string][]string)
+	for sourceID, converter := range i.converters {
+		name := converter.backend.Name()
+		formats, ok := probed[name]
+		if !ok {
+			version, probeFormats, err := converter.backend.Probe()
+			if err != nil {
+				slog.Warn("converter backend not available", "backend", name, "version", version, "error", err)
+			} else {
+				slog.Info("converter backend", "backend", name, "version", version, "formats", probeFormats)
+			}
+			formats = probeFormats
+			probed[name] = formats
+		}
+		if !converter.canResize() || formats == nil {
+			continue
+		}
+		required := []string{"heic", converter.config.AnimatedFormat}
+		for _, rendition := range converter.config.Renditions {
+			required = append(required, rendition.Format)
+		}
+		for _, format := range required {
+			if !slices.Contains(formats, format) {
+				slog.Warn("converter backend can not write format", "backend", name, "sourceID", sourceID, "format", format)
+			}
+		}
+	}
+}
 func (i *ImageConvert) Unload() {
 }
 func (i *ImageConvert) GetService(serviceID interfaces.ServiceID) (interfaces.IService, error) {
@@ -53,33 +181,216 @@ func (i *ImageConvert) GetService(serviceID interfaces.ServiceID) (interfaces.IS
 	}
 	return nil, fmt.Errorf("service not found")
 }
-func (i *ImageConvert) ConvertHEIC(input, output string) error {
+
+// converter 返回 source 的配置, 没有单独配置时使用全局配置
+func (i *ImageConvert) converter(sourceID string) *sourceConverter {
+	if converter, ok := i.converters[sourceID]; ok {
+		return converter
+	}
+	return i.converters[""]
+}
+func (i *ImageConvert) ConvertHEIC(sourceID, input, output string) error {
 	logger := slog.With("input", input, "output", output)
+	converter := i.converter(sourceID)
 	outputDir := path.Dir(output)
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		logger.Error("create image output dir failed", "path", outputDir, "error", err)
 		return err
 	}
 	if _, err := os.Stat(output); err != nil {
-		cmd := exec.Command("magick", input, output)
-		var errOut strings.Builder
-		cmd.Stderr = &errOut
-		err := cmd.Run()
+		if err := converter.backend.Convert(input, output, convertOptions{}); err != nil {
+			logger.Error("convert image failed", "backend", converter.backend.Name(), "error", err)
+			return err
+		}
+	}
+	return converter.createRenditions(input, output)
+}
+
+// renditionPath output 对应的 rendition 的路径
+func renditionPath(output string, rendition config.RenditionConfig) string {
+	return strings.TrimSuffix(output, path.Ext(output)) + renditionSuffix(rendition)
+}
+
+// missingRenditions 是否有还没有生成的 rendition
+func (c *sourceConverter) missingRenditions(output string) bool {
+	if !c.canResize() {
+		return false
+	}
+	for _, rendition := range c.config.Renditions {
+		if _, err := os.Stat(renditionPath(output, rendition)); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// createRenditions 从 input 的第一帧生成 output 的所有 rendition, backend 不支持时跳过
+func (c *sourceConverter) createRenditions(input, output string) error {
+	if !c.canResize() {
+		return nil
+	}
+	for _, rendition := range c.config.Renditions {
+		outputPath := renditionPath(output, rendition)
+		if _, err := os.Stat(outputPath); err == nil {
+			continue
+		}
+		options := convertOptions{MaxWidth: rendition.MaxWidth, MaxHeight: rendition.MaxHeight, Quality: rendition.Quality}
+		if err := c.backend.Convert(input, outputPath, options); err != nil {
+			slog.Error("create rendition failed", "input", input, "output", outputPath, "rendition", rendition.Name, "backend", c.backend.Name(), "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *ImageConvert) RenditionSuffixes(sourceID string) map[string]string {
+	converter := i.converter(sourceID)
+	suffixes := make(map[string]string)
+	if !converter.canResize() {
+		return suffixes
+	}
+	for _, rendition := range converter.config.Renditions {
+		suffixes[rendition.Name] = renditionSuffix(rendition)
+	}
+	return suffixes
+}
+
+func (i *ImageConvert) OutputExtension(sourceID string, mediaType models.MediaType, sourceMediaType string) string {
+	converter := i.converter(sourceID)
+	switch mediaType {
+	case models.MediaTypeVideo:
+		if converter.config.Video.Transcode {
+			return ".mp4"
+		}
+		return util.ExtensionForMediaType(sourceMediaType)
+	}
+	if !converter.canResize() {
+		return util.ExtensionForMediaType(sourceMediaType)
+	}
+	if mediaType == models.MediaTypeAnimated {
+		return "." + converter.config.AnimatedFormat
+	}
+	return ".heic"
+}
+
+// ConvertAnimated 动图和输出格式相同时直接复制, 否则转换并保留所有帧
+func (i *ImageConvert) ConvertAnimated(sourceID, input, output string) error {
+	logger := slog.With("input", input, "output", output)
+	converter := i.converter(sourceID)
+	outputDir := path.Dir(output)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		logger.Error("create image output dir failed", "path", outputDir, "error", err)
+		return err
+	}
+	if _, err := os.Stat(output); err != nil {
+		sourceMediaType, err := sniffFile(input)
 		if err != nil {
-			logger.Error("convert image failed", "error", err, "stderr", errOut.String(), "exit code", cmd.ProcessState.ExitCode(), "cmd", cmd.String())
+			logger.Error("read input failed", "error", err)
 			return err
 		}
+		if util.ExtensionForMediaType(sourceMediaType) == path.Ext(output) {
+			err = copyFile(input, output)
+			if err != nil {
+				logger.Error("copy animated image failed", "error", err)
+			}
+		} else {
+			err = converter.backend.Convert(input, output, convertOptions{Animated: true})
+			if err != nil {
+				logger.Error("convert animated image failed", "backend", converter.backend.Name(), "error", err)
+			}
+		}
+		if err != nil {
+			os.Remove(output)
+			return err
+		}
+	}
+	return converter.createRenditions(input, output)
+}
+
+// ConvertVideo 默认直接保存原始文件, 开启 Video.Transcode 时用 ffmpeg 转换成 h264 的 mp4, 缩略图从第一帧生成
+func (i *ImageConvert) ConvertVideo(sourceID, input, output string) error {
+	logger := slog.With("input", input, "output", output)
+	converter := i.converter(sourceID)
+	outputDir := path.Dir(output)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		logger.Error("create video output dir failed", "path", outputDir, "error", err)
+		return err
 	}
-	thumbnailPath := strings.Replace(output, ".heic", "@320.heic", 1)
-	if _, err := os.Stat(thumbnailPath); err != nil {
-		cmd := exec.Command("magick", input, "-resize", "320x", thumbnailPath)
-		var errOut strings.Builder
-		cmd.Stderr = &errOut
-		err := cmd.Run()
+	if _, err := os.Stat(output); err != nil {
+		if converter.config.Video.Transcode {
+			err = runCommand(logger, "transcode video failed", "ffmpeg", "-y", "-i", input,
+				"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", "-c:a", "aac", output)
+		} else {
+			err = copyFile(input, output)
+			if err != nil {
+				logger.Error("copy video failed", "error", err)
+			}
+		}
 		if err != nil {
-			logger.Error("create thumbnail image failed", "error", err, "stderr", errOut.String(), "exit code", cmd.ProcessState.ExitCode(), "cmd", cmd.String())
+			os.Remove(output)
 			return err
 		}
 	}
+	if !converter.missingRenditions(output) {
+		return nil
+	}
+	posterPath := strings.TrimSuffix(output, path.Ext(output)) + ".poster.png"
+	defer os.Remove(posterPath)
+	if err := runCommand(logger, "extract poster frame failed", "ffmpeg", "-y", "-i", input, "-frames:v", "1", posterPath); err != nil {
+		return err
+	}
+	return converter.createRenditions(posterPath, output)
+}
+
+// Resize source 使用 passthrough 时使用全局配置的 backend
+func (i *ImageConvert) Resize(sourceID, input, output string, width int) error {
+	converter := i.converter(sourceID)
+	if !converter.canResize() {
+		converter = i.converters[""]
+	}
+	if !converter.canResize() {
+		return errConvertNotSupported
+	}
+	if err := converter.backend.Convert(input, output, convertOptions{MaxWidth: width}); err != nil {
+		slog.Error("resize image failed", "input", input, "output", output, "width", width, "backend", converter.backend.Name(), "error", err)
+		return err
+	}
 	return nil
 }
+
+// sniffFile 根据文件头识别文件类型
+func sniffFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return util.SniffMediaType(head[:n]), nil
+}
+
+// runCommand 执行外部命令, 失败时记录 stderr
+func runCommand(logger *slog.Logger, message string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	var errOut strings.Builder
+	cmd.Stderr = &errOut
+	if err := cmd.Run(); err != nil {
+		logger.Error(message, "error", err, "stderr", errOut.String(), "exit code", cmd.ProcessState.ExitCode(), "cmd", cmd.String())
+		return err
+	}
+	return nil
+}
+
+// PerceptualHash 把图片的第一帧缩小成 9x8 的灰度图, 计算 dHash
+// 所有 source 都使用全局配置的 backend, 保证结果可以互相比较
+func (i *ImageConvert) PerceptualHash(input string) (uint64, error) {
+	gray, err := i.converters[""].backend.Gray(input, util.DHashWidth, util.DHashHeight)
+	if err != nil {
+		return 0, err
+	}
+	return util.DHash(gray)
+}
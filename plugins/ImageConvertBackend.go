@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"ywwzwb/imagespider/models/config"
+)
+
+// converterBackend 实际执行转换的工具, 质量和无损模式在创建时由配置决定
+type converterBackend interface {
+	Name() string
+	// Probe 检查工具是否可用, 返回版本和支持输出的格式(扩展名, 不含 .)
+	Probe() (version string, formats []string, err error)
+	// Convert 转换图片, 输出的格式由 output 的扩展名决定
+	Convert(input, output string, options convertOptions) error
+	// Gray 把第一帧缩放成 width x height 的灰度图, 返回每个像素的亮度
+	Gray(input string, width, height int) ([]byte, error)
+}
+
+type convertOptions struct {
+	MaxWidth  int  // 大于 0 时等比缩小到不超过这个宽度
+	MaxHeight int  // 大于 0 时等比缩小到不超过这个高度
+	Quality   int  // 大于 0 时代替配置中的 quality
+	Animated  bool // 保留所有帧, 否则只转换第一帧
+}
+
+func (o convertOptions) resize() bool {
+	return o.MaxWidth > 0 || o.MaxHeight > 0
+}
+
+// errConvertNotSupported backend 不支持的操作, 例如 passthrough 不能生成缩略图
+var errConvertNotSupported = errors.New("not supported by converter backend")
+
+func newConverterBackend(convertConfig *config.ImageConvertConfig) (converterBackend, error) {
+	if convertConfig.Quality < 0 || convertConfig.Quality > 100 {
+		return nil, fmt.Errorf("invalid quality: %d", convertConfig.Quality)
+	}
+	switch convertConfig.Backend {
+	case "", config.ConverterBackendImageMagick:
+		return &magickBackend{quality: convertConfig.Quality, lossless: convertConfig.LosslessModeEnabled}, nil
+	case config.ConverterBackendVips:
+		return &vipsBackend{quality: convertConfig.Quality, lossless: convertConfig.LosslessModeEnabled}, nil
+	case config.ConverterBackendPassthrough:
+		return &passthroughBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown converter backend: %s", convertConfig.Backend)
+	}
+}
+
+// passthroughBackend 不转换, 直接保存下载的文件, 不能生成缩略图和计算 dHash
+type passthroughBackend struct{}
+
+func (p *passthroughBackend) Name() string {
+	return config.ConverterBackendPassthrough
+}
+func (p *passthroughBackend) Probe() (string, []string, error) {
+	return "builtin", nil, nil
+}
+func (p *passthroughBackend) Convert(input, output string, options convertOptions) error {
+	if options.resize() {
+		return errConvertNotSupported
+	}
+	return copyFile(input, output)
+}
+func (p *passthroughBackend) Gray(input string, width, height int) ([]byte, error) {
+	return nil, errConvertNotSupported
+}
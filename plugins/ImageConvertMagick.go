@@ -0,0 +1,101 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"ywwzwb/imagespider/models/config"
+)
+
+// magickBackend 使用 ImageMagick 7 的 magick 命令
+type magickBackend struct {
+	quality  int
+	lossless bool
+}
+
+func (m *magickBackend) Name() string {
+	return config.ConverterBackendImageMagick
+}
+
+// Probe magick -version 的第一行是版本, magick -list format 中 mode 包含 w 的是可以输出的格式
+func (m *magickBackend) Probe() (string, []string, error) {
+	out, err := exec.Command("magick", "-version").Output()
+	if err != nil {
+		return "", nil, err
+	}
+	version, _, _ := strings.Cut(string(out), "\n")
+	out, err = exec.Command("magick", "-list", "format").Output()
+	if err != nil {
+		return strings.TrimSpace(version), nil, err
+	}
+	formats := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.Contains(fields[2], "w") {
+			continue
+		}
+		format := strings.ToLower(strings.TrimSuffix(fields[0], "*"))
+		if slices.Contains(converterOutputFormats, format) && !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return strings.TrimSpace(version), formats, nil
+}
+func (m *magickBackend) Convert(input, output string, options convertOptions) error {
+	source := input + "[0]"
+	if options.Animated {
+		source = input
+		// apng 需要加上前缀才会读取所有帧
+		if mediaType, err := sniffFile(input); err == nil && mediaType == "image/png" {
+			source = "apng:" + input
+		}
+	}
+	args := []string{source}
+	if options.resize() {
+		// > 表示只缩小, 为 0 的一边不限制
+		geometry := "x"
+		if options.MaxWidth > 0 {
+			geometry = strconv.Itoa(options.MaxWidth) + geometry
+		}
+		if options.MaxHeight > 0 {
+			geometry += strconv.Itoa(options.MaxHeight)
+		}
+		args = append(args, "-resize", geometry+">")
+	}
+	args = append(args, m.qualityArgs(path.Ext(output), options.Quality)...)
+	args = append(args, output)
+	return runCommand(slog.With("input", input, "output", output), "magick convert failed", "magick", args...)
+}
+func (m *magickBackend) qualityArgs(ext string, quality int) []string {
+	if m.lossless {
+		if ext == ".webp" {
+			return []string{"-define", "webp:lossless=true"}
+		}
+		return []string{"-quality", "100"}
+	}
+	if quality <= 0 {
+		quality = m.quality
+	}
+	if quality > 0 {
+		return []string{"-quality", strconv.Itoa(quality)}
+	}
+	return nil
+}
+func (m *magickBackend) Gray(input string, width, height int) ([]byte, error) {
+	cmd := exec.Command("magick", input+"[0]", "-colorspace", "Gray", "-resize",
+		fmt.Sprintf("%dx%d!", width, height), "-depth", "8", "gray:-")
+	var out bytes.Buffer
+	var errOut strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	if err := cmd.Run(); err != nil {
+		slog.Error("magick gray failed", "input", input, "error", err, "stderr", errOut.String(), "exit code", cmd.ProcessState.ExitCode(), "cmd", cmd.String())
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package plugins
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"ywwzwb/imagespider/models/config"
+)
+
+// vipsBackend 使用 libvips 的 vips 命令, 保存的参数写在输出文件名后面, 例如 out.webp[Q=80,lossless]
+type vipsBackend struct {
+	quality  int
+	lossless bool
+}
+
+const vipsUnlimitedSize = 100000000
+
+// vipsSavers vips -l foreign 中的 saver 和对应的输出格式
+var vipsSavers = map[string][]string{
+	"heifsave": {"heic", "avif"},
+	"webpsave": {"webp"},
+	"jpegsave": {"jpeg"},
+	"pngsave":  {"png"},
+	"gifsave":  {"gif"},
+}
+
+func (v *vipsBackend) Name() string {
+	return config.ConverterBackendVips
+}
+func (v *vipsBackend) Probe() (string, []string, error) {
+	out, err := exec.Command("vips", "--version").Output()
+	if err != nil {
+		return "", nil, err
+	}
+	version := strings.TrimSpace(string(out))
+	out, err = exec.Command("vips", "-l", "foreign").Output()
+	if err != nil {
+		return version, nil, err
+	}
+	formats := make([]string, 0)
+	for saver, saverFormats := range vipsSavers {
+		if strings.Contains(string(out), "("+saver) {
+			formats = append(formats, saverFormats...)
+		}
+	}
+	slices.Sort(formats)
+	return version, formats, nil
+}
+func (v *vipsBackend) Convert(input, output string, options convertOptions) error {
+	source := input
+	if options.Animated {
+		source = input + "[n=-1]"
+	}
+	target := output
+	if saveOptions := v.saveOptions(path.Ext(output), options.Quality); len(saveOptions) != 0 {
+		target = output + "[" + strings.Join(saveOptions, ",") + "]"
+	}
+	logger := slog.With("input", input, "output", output)
+	if options.resize() {
+		// 不限制的一边给一个足够大的值
+		width, height := options.MaxWidth, options.MaxHeight
+		if width <= 0 {
+			width = vipsUnlimitedSize
+		}
+		if height <= 0 {
+			height = vipsUnlimitedSize
+		}
+		return runCommand(logger, "vips thumbnail failed", "vips", "thumbnail", source, target, strconv.Itoa(width),
+			"--height", strconv.Itoa(height), "--size", "down")
+	}
+	return runCommand(logger, "vips copy failed", "vips", "copy", source, target)
+}
+func (v *vipsBackend) saveOptions(ext string, quality int) []string {
+	if quality <= 0 {
+		quality = v.quality
+	}
+	switch {
+	case v.lossless && (ext == ".webp" || ext == ".heic" || ext == ".avif"):
+		return []string{"lossless"}
+	case v.lossless && (ext == ".jpg" || ext == ".jpeg"):
+		return []string{"Q=100"}
+	case quality > 0 && ext != ".png" && ext != ".gif":
+		return []string{"Q=" + strconv.Itoa(quality)}
+	default:
+		return nil
+	}
+}
+
+// Gray vips 没有直接输出灰度数据的命令, 先缩放成 png 再读取
+func (v *vipsBackend) Gray(input string, width, height int) ([]byte, error) {
+	tempFile, err := os.CreateTemp("", "gray-*.png")
+	if err != nil {
+		return nil, err
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+	err = runCommand(slog.With("input", input), "vips gray failed", "vips", "thumbnail", input, tempFile.Name(),
+		strconv.Itoa(width), "--height", strconv.Itoa(height), "--size", "force")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(tempFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != width || bounds.Dy() != height {
+		return nil, fmt.Errorf("unexpected thumbnail size: %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	gray := make([]byte, 0, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray = append(gray, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return gray, nil
+}
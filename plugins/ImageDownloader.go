@@ -1,22 +1,31 @@
 package plugins
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	"maps"
 	"net/http"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"ywwzwb/imagespider/interfaces"
 	"ywwzwb/imagespider/models"
 	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/util"
 )
 
 const ImageDownloaderPluginID string = "ImageDownloader"
 
+// 下载临时目录, 在 WorkDir 中
+const downloadTempDirName = "download_tmp"
+
 const fetchBatchSize = 10
 const fetchInterval = 60 * time.Second
 
@@ -28,6 +37,13 @@ type ImageDownloader struct {
 	downloadTempPath    string
 	dbService           interfaces.IDBService
 	imageConvertService interfaces.IImageConvertService
+	quotaService        interfaces.IQuotaService
+	storageService      interfaces.IStorageService
+	bandwidth           *bandwidthLimiters
+	queuesMtx           sync.Mutex
+	queues              map[string]*downloadQueue
+	progress            *progressTracker
+	contentLocks        *util.KeyedMutex // 转换和保存按 content hash 串行, 后完成的直接共用前面保存的文件
 	goroutinCount       atomic.Int32
 }
 
@@ -35,6 +51,10 @@ func newImageDownloader() *ImageDownloader {
 	downloader := ImageDownloader{}
 	downloader.stopChain = make(chan bool)
 	downloader.stopFinishChain = make(chan bool)
+	downloader.bandwidth = newBandwidthLimiters()
+	downloader.queues = make(map[string]*downloadQueue)
+	downloader.progress = newProgressTracker()
+	downloader.contentLocks = util.NewKeyedMutex()
 	return &downloader
 }
 
@@ -51,8 +71,9 @@ func (i *ImageDownloader) ID() string {
 }
 func (i *ImageDownloader) Load(app interfaces.IApplication) error {
 	i.app = app
+	i.bandwidth.add(globalBandwidthKey, &app.GetAppConfig().DownloadBandwidth)
 	// 创建临时目录用于下载
-	i.downloadTempPath = path.Join(app.GetAppConfig().WorkDir, "download_tmp")
+	i.downloadTempPath = path.Join(app.GetAppConfig().WorkDir, downloadTempDirName)
 	if err := os.MkdirAll(i.downloadTempPath, 0755); err != nil {
 		slog.Error("create download temp dir failed", "path", i.downloadTempPath, "error", err)
 		return err
@@ -70,6 +91,18 @@ func (i *ImageDownloader) Load(app interfaces.IApplication) error {
 		return err
 	}
 	i.imageConvertService = imageConvertService.(interfaces.IImageConvertService)
+	quotaService, err := app.GetService(i.ID(), QuotaPluginID, interfaces.QuotaServiceID)
+	if err != nil {
+		slog.Error("get quota service failed", "error", err)
+		return err
+	}
+	i.quotaService = quotaService.(interfaces.IQuotaService)
+	storageService, err := app.GetService(i.ID(), StoragePluginID, interfaces.StorageServiceID)
+	if err != nil {
+		slog.Error("get storage service failed", "error", err)
+		return err
+	}
+	i.storageService = storageService.(interfaces.IStorageService)
 	return nil
 }
 func (i *ImageDownloader) Unload() {
@@ -85,18 +118,176 @@ func (i *ImageDownloader) GetService(serviceID interfaces.ServiceID) (interfaces
 	}
 	return nil, fmt.Errorf("service not found")
 }
-func (i *ImageDownloader) AddConfig(sourceID string, config *config.ImageDownloaderConfig) {
+
+// downloadQueue 一个 source 的下载队列, feeder 从数据库读取待下载的数据放入队列, 多个 worker 从队列中取出下载
+// inflight 记录已经放入队列但还没有处理完的数据, 保证同一条数据不会被两个 worker 同时处理
+// finished 记录本次读取数据库之后才处理完的数据, 这些数据在本次读取的结果中还是待下载的状态, 需要跳过
+// waiters 记录等待某条数据(用 meta ID 索引)处理完成的请求, 处理完成时关闭
+type downloadQueue struct {
+	sourceID    string
+	config      *config.ImageDownloaderConfig
+	refresher   interfaces.ImageURLRefresher
+	queue       chan models.ImageMeta
+	wake        chan struct{}
+	urgent      chan struct{}
+	inflightMtx sync.Mutex
+	inflight    map[string]struct{}
+	finished    map[string]struct{}
+	waiters     map[string][]chan struct{}
+}
+
+func newDownloadQueue(sourceID string, config *config.ImageDownloaderConfig, refresher interfaces.ImageURLRefresher) *downloadQueue {
+	return &downloadQueue{
+		sourceID:  sourceID,
+		config:    config,
+		refresher: refresher,
+		queue:     make(chan models.ImageMeta),
+		wake:      make(chan struct{}, 1),
+		urgent:    make(chan struct{}, 1),
+		inflight:  make(map[string]struct{}),
+		finished:  make(map[string]struct{}),
+		waiters:   make(map[string][]chan struct{}),
+	}
+}
+
+// beginFetch 在读取数据库之前调用, 之前处理完的数据已经反映在数据库中了
+func (q *downloadQueue) beginFetch() {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	clear(q.finished)
+}
+
+// tryAcquire 标记数据为处理中, 已经在处理中时返回 false
+func (q *downloadQueue) tryAcquire(meta models.ImageMeta) bool {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	hash := meta.Hash()
+	if _, ok := q.inflight[hash]; ok {
+		return false
+	}
+	if _, ok := q.finished[hash]; ok {
+		return false
+	}
+	q.inflight[hash] = struct{}{}
+	return true
+}
+
+// cancel 取消 tryAcquire, 数据没有被处理, 下次读取时还可以放入队列
+func (q *downloadQueue) cancel(meta models.ImageMeta) {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	delete(q.inflight, meta.Hash())
+}
+func (q *downloadQueue) release(meta models.ImageMeta) {
+	q.inflightMtx.Lock()
+	delete(q.inflight, meta.Hash())
+	q.finished[meta.Hash()] = struct{}{}
+	for _, waiter := range q.waiters[meta.ID] {
+		close(waiter)
+	}
+	delete(q.waiters, meta.ID)
+	q.inflightMtx.Unlock()
+	// 通知 feeder 补充队列
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// addWaiter 返回一个在 metaID 处理完成时关闭的 channel
+func (q *downloadQueue) addWaiter(metaID string) chan struct{} {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	waiter := make(chan struct{})
+	q.waiters[metaID] = append(q.waiters[metaID], waiter)
+	return waiter
+}
+func (q *downloadQueue) removeWaiter(metaID string, waiter chan struct{}) {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	waiters := q.waiters[metaID]
+	for idx, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:idx], waiters[idx+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(q.waiters, metaID)
+	} else {
+		q.waiters[metaID] = waiters
+	}
+}
+
+// notifyUrgent 通知 feeder 有优先下载的数据, 需要立即重新读取数据库
+func (q *downloadQueue) notifyUrgent() {
+	select {
+	case q.urgent <- struct{}{}:
+	default:
+	}
+}
+func (q *downloadQueue) parallelism() int {
+	if q.config.Parallelism <= 0 {
+		return 1
+	}
+	return q.config.Parallelism
+}
+
+func (i *ImageDownloader) AddConfig(sourceID string, config *config.ImageDownloaderConfig, refresher interfaces.ImageURLRefresher) {
+	queue := newDownloadQueue(sourceID, config, refresher)
+	i.queuesMtx.Lock()
+	i.queues[sourceID] = queue
+	i.queuesMtx.Unlock()
+	i.bandwidth.add(sourceID, &config.Bandwidth)
 	i.goroutinCount.Add(1)
-	go i.downloadForSourceID(sourceID, config)
+	go i.feedQueue(queue)
+	for idx := 0; idx < queue.parallelism(); idx++ {
+		i.goroutinCount.Add(1)
+		go i.downloadWorker(queue, idx)
+	}
+}
+
+// onDemandDownloadPriority 通过 API 请求下载的图片的优先级, 默认为 0
+const onDemandDownloadPriority = 100
+
+// RequestDownload 提高图片的下载优先级, 失败的图片会重新加入队列, wait 为 true 时等待处理完成或者 ctx 结束
+func (i *ImageDownloader) RequestDownload(ctx context.Context, sourceID, metaID string, wait bool) error {
+	i.queuesMtx.Lock()
+	queue, ok := i.queues[sourceID]
+	i.queuesMtx.Unlock()
+	if !ok {
+		return NotFound
+	}
+	// 先注册再修改数据库, 避免在两者之间下载完成时错过通知
+	waiter := queue.addWaiter(metaID)
+	defer queue.removeWaiter(metaID, waiter)
+	status, err := i.dbService.PrioritizeDownload(sourceID, metaID, onDemandDownloadPriority)
+	if err != nil {
+		return err
+	}
+	if status == models.DownloadStatusDone {
+		return nil
+	}
+	queue.notifyUrgent()
+	if !wait {
+		return nil
+	}
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
-func (i *ImageDownloader) downloadForSourceID(sourceID string, config *config.ImageDownloaderConfig) {
-	logger := slog.With("sourceID", sourceID)
-	logger.Info("start download")
+func (i *ImageDownloader) feedQueue(queue *downloadQueue) {
+	logger := slog.With("sourceID", queue.sourceID)
+	logger.Info("start download", "parallelism", queue.parallelism())
+	batchSize := max(fetchBatchSize, queue.parallelism()*2)
+feed:
 	for {
-		// 读取几条没有本地路径的资源
-		metas := i.dbService.GetMetaLocalPathNULL(sourceID, fetchBatchSize)
-		if len(metas) == 0 {
-			logger.Info("no more data, check later")
+		if !i.quotaService.AllowDownload(queue.sourceID) {
+			// 配额用完了, 剩下的保持在队列中, 稍后再检查
+			logger.Info("download quota exceeded, check later")
 			select {
 			case <-i.stopChain:
 				goto exit
@@ -104,61 +295,142 @@ func (i *ImageDownloader) downloadForSourceID(sourceID string, config *config.Im
 				continue
 			}
 		}
-		transport := &http.Transport{
-			// 设置连接超时时间
-			DialContext: (&net.Dialer{
-				Timeout: time.Duration(config.ConnectTimeout) * time.Second,
-			}).DialContext,
-		}
-		httpClient := &http.Client{
-			Transport: transport,
-		}
+		// 读取几条等待下载或者到了重试时间的资源
+		queue.beginFetch()
+		metas := i.dbService.GetMetaToDownload(queue.sourceID, queue.config.WatchedTags, batchSize)
+		dispatched := 0
 		for _, meta := range metas {
+			if !queue.tryAcquire(meta) {
+				continue
+			}
 			select {
 			case <-i.stopChain:
 				goto exit
-			default:
+			case <-queue.urgent:
+				// 有优先下载的请求, 放弃这一批, 重新读取
+				queue.cancel(meta)
+				continue feed
+			case queue.queue <- meta:
+				dispatched++
+			}
+			if !i.quotaService.AllowDownload(queue.sourceID) {
+				break
 			}
+		}
+		if dispatched > 0 {
+			continue
+		}
+		if len(metas) == 0 {
+			logger.Info("no more data, check later")
+		}
+		// 没有新的数据(或者都在处理中), 等待 worker 处理完或者稍后再检查
+		select {
+		case <-i.stopChain:
+			goto exit
+		case <-queue.wake:
+		case <-queue.urgent:
+		case <-time.After(fetchInterval):
+		}
+	}
+exit:
+	i.stopFinishChain <- true
+}
+func (i *ImageDownloader) downloadWorker(queue *downloadQueue, workerIdx int) {
+	logger := slog.With("sourceID", queue.sourceID, "worker", workerIdx)
+	logger.Debug("start download worker")
+	httpClient := util.NewHTTPClient(queue.config.ConnectTimeout)
+	for {
+		select {
+		case <-i.stopChain:
+			goto exit
+		case meta := <-queue.queue:
 			var exit bool = false
-			i.downloadImage(httpClient, sourceID, meta, config, &exit)
+			i.downloadImage(httpClient, queue.sourceID, meta, queue.config, queue.refresher, &exit)
+			queue.release(meta)
 			if exit {
 				goto exit
 			}
 		}
 	}
 exit:
+	logger.Debug("stop download worker")
 	i.stopFinishChain <- true
 }
-func (i *ImageDownloader) downloadImage(httpClient *http.Client, sourceID string, meta models.ImageMeta, config *config.ImageDownloaderConfig, exit *bool) {
+func (i *ImageDownloader) downloadImage(httpClient *http.Client, sourceID string, meta models.ImageMeta, config *config.ImageDownloaderConfig,
+	refresher interfaces.ImageURLRefresher, exit *bool) {
 	var req *http.Request
 	var resp *http.Response = nil
 	var output *os.File = nil
+	var body io.Reader
 	var startDownloadPos int64 = 0
+	var written int64 = 0
+	var fileSize int64 = 0
 	var stat os.FileInfo
+	var openFlag int
+	var expectedSize int64
+	var imageInfo *util.ImageInfo
+	var convertedPath string
+	var hashInput string
+	// 每次下载只重新读取一次图片地址
+	var refreshed bool
+	// 之前的版本只保存 heic
+	var mediaType = models.MediaTypeImage
+	var outputExt = ".heic"
 	hash := meta.Hash()
 	logger := slog.With("sourceID", sourceID).With("metaID", meta.ID, "hash", hash)
-	tempDownloadFilePath := path.Join(i.downloadTempPath, hash+path.Ext(meta.ImageURL))
+	progress := i.progress.start(meta)
+	defer i.progress.finish(meta)
+	renditionSuffixes := i.imageConvertService.RenditionSuffixes(sourceID)
+	// 按优先级尝试各个版本的地址, 失败时使用下一个
+	candidates := meta.Candidates()
+	candidateIdx := 0
+	tempDownloadFilePath := i.tempDownloadPath(hash, candidates[candidateIdx])
 	tempDownloadFilePathDownloading := tempDownloadFilePath + ".downloading"
+	// 之前的版本按照 source 和 ID 保存文件, 已经存在时直接使用, 新下载的文件按内容保存
 	imageOutputPath := path.Join(hash[0:2], hash[2:4], hash[4:6], hash)
-	imageOutputAbsolutePath := path.Join(i.app.GetAppConfig().ImageDir, imageOutputPath)
-	_, err := os.Stat(imageOutputAbsolutePath + ".heic")
+	i.dbService.UpdateDownloadStatus(meta, models.DownloadStatusDownloading)
+	_, err := i.storageService.Stat(imageOutputPath + ".heic")
 	if err == nil {
 		logger.Info("converted file exists, save it")
 		goto save
 	}
-	_, err = os.Stat(tempDownloadFilePath)
-	if err == nil {
-		logger.Info("file download path exists, convert it")
-		goto convert
+	for idx, candidate := range candidates {
+		if _, err := os.Stat(i.tempDownloadPath(hash, candidate)); err == nil {
+			logger.Info("file download path exists, convert it", "variant", candidate.Variant)
+			candidateIdx = idx
+			tempDownloadFilePath = i.tempDownloadPath(hash, candidate)
+			goto convert
+		}
 	}
+fetch:
+	tempDownloadFilePath = i.tempDownloadPath(hash, candidates[candidateIdx])
+	tempDownloadFilePathDownloading = tempDownloadFilePath + ".downloading"
+	startDownloadPos = 0
 	stat, err = os.Stat(tempDownloadFilePathDownloading)
 	if err == nil {
 		startDownloadPos = stat.Size()
 		logger.Info("try resume download from", "offset", startDownloadPos)
 	}
-	logger.Info("start download")
+	// 通过 API 请求下载的图片不检查预览图
+	if candidateIdx == 0 && startDownloadPos == 0 && meta.DownloadPriority <= 0 {
+		similar := i.findDuplicateByPreview(httpClient, meta, config, logger, exit)
+		if *exit {
+			i.dbService.UpdateDownloadStatus(meta, models.DownloadStatusPending)
+			return
+		}
+		if similar != nil {
+			logger.Info("preview matches an existing image, skip", "similarSourceID", similar.SourceID, "similarID", similar.ID)
+			if err := i.dbService.MarkMetaDownloadSkipped(meta, fmt.Sprintf("preview matches %s/%s", similar.SourceID, similar.ID)); err != nil {
+				// 不能停留在下载中的状态, 稍后重新处理
+				logger.Error("mark download skipped failed", "error", err)
+				i.dbService.UpdateDownloadStatus(meta, models.DownloadStatusPending)
+			}
+			return
+		}
+	}
+	logger.Info("start download", "variant", candidates[candidateIdx].Variant)
 	for idx := 0; idx < int(config.ErrorRetryMaxCount); idx++ {
-		req, err = http.NewRequest("GET", meta.ImageURL, nil)
+		req, err = http.NewRequest("GET", candidates[candidateIdx].URL, nil)
 		if err != nil {
 			logger.Error("create request failed", "error", err)
 			break
@@ -170,12 +442,21 @@ func (i *ImageDownloader) downloadImage(httpClient *http.Client, sourceID string
 			req.Header.Add("Range", fmt.Sprintf("bytes=%d-", startDownloadPos))
 		}
 		resp, err = httpClient.Do(req)
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			(candidateIdx+1 < len(candidates) || (refresher != nil && !refreshed && isExpiredURLResponse(resp))) {
+			// 客户端错误重试也不会成功, 直接刷新地址或者尝试下一个版本
+			break
+		}
 		if err != nil || (resp.StatusCode != 200 && resp.StatusCode != 206) {
+			if resp != nil {
+				resp.Body.Close()
+			}
 			startDownloadPos = 0
 			os.Remove(tempDownloadFilePathDownloading)
 			select {
 			case <-i.stopChain:
 				*exit = true
+				i.dbService.UpdateDownloadStatus(meta, models.DownloadStatusPending)
 				return
 			case <-time.After(time.Duration(config.ErrorRetryInterval) * time.Second):
 				continue
@@ -185,67 +466,352 @@ func (i *ImageDownloader) downloadImage(httpClient *http.Client, sourceID string
 	}
 	if resp == nil {
 		logger.Error("fetch image failed, save empty path and skip for now", "error", err)
-		empty := ""
-		meta.LocalPath = &empty
-		if err := i.dbService.UpdateLocalPathForMeta(meta); err != nil {
-			logger.Error("update local path failed", "error", err)
-			return
-		}
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("fetch image failed: %v", err), false)
 		return
 	}
+	if refresher != nil && !refreshed && isExpiredURLResponse(resp) {
+		// 地址中的签名可能已经过期, 重新读取 meta 页面之后从第一个版本开始重试
+		refreshed = true
+		resp.Body.Close()
+		if i.refreshImageURL(&meta, refresher, logger) {
+			candidates = meta.Candidates()
+			candidateIdx = 0
+			goto fetch
+		}
+	}
+	if candidateIdx+1 < len(candidates) && !isImageResponse(resp) {
+		logger.Warn("image variant not available, try next", "variant", candidates[candidateIdx].Variant,
+			"status", resp.Status, "contentType", resp.Header.Get("Content-Type"))
+		resp.Body.Close()
+		os.Remove(tempDownloadFilePathDownloading)
+		candidateIdx++
+		goto fetch
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		logger.Error("fetch image failed, save empty path and skip for now", "status", resp.Status)
+		// 资源已经不存在了, 不再自动重试
+		gone := resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+		i.markDownloadFailed(logger, meta, config, "unexpected status: "+resp.Status, gone)
+		return
+	}
+	if contentType := resp.Header.Get("Content-Type"); !util.IsImageContentType(contentType) {
+		logger.Error("response is not an image, save empty path and skip for now", "contentType", contentType)
+		os.Remove(tempDownloadFilePathDownloading)
+		i.markDownloadFailed(logger, meta, config, "unexpected content type: "+contentType, false)
+		return
+	}
+	// 服务器不支持 Range 时会返回完整的内容, 需要从头写入
+	openFlag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resp.StatusCode == http.StatusOK {
+		startDownloadPos = 0
+		openFlag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	expectedSize = expectedContentSize(resp, startDownloadPos)
+	progress.beginTransfer(startDownloadPos, expectedSize)
 	// 把resp.body 保存到 tempDownloadFilePath 中
-	output, err = os.OpenFile(tempDownloadFilePathDownloading, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	output, err = os.OpenFile(tempDownloadFilePathDownloading, openFlag, 0644)
 	if err != nil {
 		logger.Error("create temp file failed", "error", err)
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("create temp file failed: %v", err), false)
 		return
 	}
+	body = i.limitReader(sourceID, resp.Body)
 	for {
-		select {
-		case <-i.stopChain:
+		var size int64
+		size, err = io.CopyN(output, body, 4*1024)
+		written += size
+		progress.addBytes(size)
+		if err == errDownloadStopped {
 			*exit = true
 			output.Close()
+			i.quotaService.AddDownloadBytes(sourceID, written)
+			i.dbService.UpdateDownloadStatus(meta, models.DownloadStatusPending)
 			return
-		default:
 		}
-		size, err := io.CopyN(output, resp.Body, 4*1024)
-		if size == 0 || err != nil {
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
 			break
 		}
 	}
 	output.Close()
+	i.quotaService.AddDownloadBytes(sourceID, written)
 	if err != nil {
 		logger.Error("write temp file failed", "error", err)
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("write temp file failed: %v", err), false)
+		return
+	}
+	if expectedSize >= 0 && startDownloadPos+written != expectedSize {
+		if startDownloadPos+written > expectedSize {
+			// 数据比声明的长, 无法续传, 下次从头下载
+			os.Remove(tempDownloadFilePathDownloading)
+		}
+		logger.Error("download size mismatch, skip for now", "expected", expectedSize, "got", startDownloadPos+written)
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("download size mismatch: expected %d bytes, got %d", expectedSize, startDownloadPos+written), false)
 		return
 	}
 	if err := os.Rename(tempDownloadFilePathDownloading, tempDownloadFilePath); err != nil {
 		logger.Error("rename temp file failed", "error", err)
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("rename temp file failed: %v", err), false)
 		return
 	}
-	logger.Info("download success, convert")
+	logger.Info("download success, validate and convert")
 convert:
-	err = i.imageConvertService.ConvertHEIC(tempDownloadFilePath, imageOutputAbsolutePath+".heic")
+	progress.setStage(downloadStageConverting)
+	if variant := candidates[candidateIdx].Variant; len(variant) != 0 {
+		meta.ImageVariant = &variant
+	}
+	imageInfo, err = validateImage(tempDownloadFilePath, &config.Validation)
+	if err != nil {
+		logger.Error("invalid image, save empty path and skip for now", "error", err)
+		os.Remove(tempDownloadFilePath)
+		_, placeholder := err.(placeholderImageError)
+		i.markDownloadFailed(logger, meta, config, err.Error(), placeholder)
+		return
+	}
+	if imageInfo.Width > 0 && imageInfo.Height > 0 {
+		meta.Width = &imageInfo.Width
+		meta.Height = &imageInfo.Height
+	}
+	switch {
+	case util.IsVideoMediaType(imageInfo.MediaType):
+		mediaType = models.MediaTypeVideo
+	case imageInfo.Animated:
+		mediaType = models.MediaTypeAnimated
+	}
+	meta.MediaType = mediaType
+	// 按内容保存, 内容相同的图片共用一个文件
+	meta.ContentHash = &imageInfo.SHA256
+	// 转换的临时文件按 content hash 命名, 从检查 blob 到保存到数据库之间不能有其他 worker 处理相同的内容
+	defer i.contentLocks.Lock(imageInfo.SHA256)()
+	if blob, err := i.dbService.GetBlob(imageInfo.SHA256); err == nil {
+		if _, err := i.storageService.Stat(blob.LocalPath); err == nil {
+			logger.Info("same content exists, share it", "contentHash", blob.ContentHash, "path", blob.LocalPath)
+			meta.LocalPath = &blob.LocalPath
+			meta.FileSize = blob.FileSize
+			meta.PerceptualHash = blob.PerceptualHash
+			meta.MediaType = blob.MediaType
+			meta.Renditions = blob.Renditions
+			meta.OriginalPath, meta.OriginalSize, meta.OriginalMimeType = blob.OriginalPath, blob.OriginalSize, blob.OriginalMimeType
+			if meta.OriginalPath == nil && config.KeepOriginal && i.keepOriginal(tempDownloadFilePath, imageInfo, &meta, logger) {
+				fileSize = *meta.OriginalSize
+				if meta.FileSize != nil {
+					fileSize += *meta.FileSize
+				}
+				meta.FileSize = &fileSize
+			}
+			if err := i.dbService.UpdateLocalPathForMeta(meta); err != nil {
+				logger.Error("update local path failed", "error", err)
+				return
+			}
+			if meta.OriginalPath != blob.OriginalPath {
+				i.quotaService.AddDiskBytes(sourceID, *meta.OriginalSize)
+			}
+			os.Remove(tempDownloadFilePath)
+			return
+		}
+		logger.Warn("blob file not found, convert again", "contentHash", blob.ContentHash, "path", blob.LocalPath)
+	}
+	imageOutputPath = contentOutputPath(imageInfo.SHA256)
+	// 先转换到下载目录中, 计算 dHash 之后再保存到存储中
+	outputExt = i.imageConvertService.OutputExtension(sourceID, mediaType, imageInfo.MediaType)
+	convertedPath = path.Join(i.downloadTempPath, imageInfo.SHA256+outputExt)
+	switch mediaType {
+	case models.MediaTypeVideo:
+		err = i.imageConvertService.ConvertVideo(sourceID, tempDownloadFilePath, convertedPath)
+	case models.MediaTypeAnimated:
+		err = i.imageConvertService.ConvertAnimated(sourceID, tempDownloadFilePath, convertedPath)
+	default:
+		err = i.imageConvertService.ConvertHEIC(sourceID, tempDownloadFilePath, convertedPath)
+	}
 	if err != nil {
-		logger.Error("convert heic failed, save empty path and skip for now", "error", err)
-		empty := ""
-		meta.LocalPath = &empty
-		if err := i.dbService.UpdateLocalPathForMeta(meta); err != nil {
-			logger.Error("update local path failed", "error", err)
+		logger.Error("convert failed, save empty path and skip for now", "mediaType", mediaType, "error", err)
+		i.markDownloadFailed(logger, meta, config, fmt.Sprintf("convert %s failed: %v", mediaType, err), false)
+		return
+	}
+	// dHash 由下载的文件的第一帧缩放成固定大小的灰度图计算, 不受转换的格式和 rendition 配置的影响
+	hashInput = tempDownloadFilePath
+	if mediaType == models.MediaTypeVideo {
+		hashInput = ""
+	}
+	if len(hashInput) != 0 {
+		if phash, err := i.imageConvertService.PerceptualHash(hashInput); err == nil {
+			signed := int64(phash)
+			meta.PerceptualHash = &signed
+		}
+	}
+	for _, suffix := range append([]string{outputExt}, slices.Collect(maps.Values(renditionSuffixes))...) {
+		localPath := strings.TrimSuffix(convertedPath, outputExt) + suffix
+		if _, err := os.Stat(localPath); err != nil && suffix != outputExt {
+			continue
+		}
+		err = i.storageService.PutFile(imageOutputPath+suffix, localPath, util.MediaTypeForExtension(path.Ext(suffix)))
+		os.Remove(localPath)
+		if err != nil {
+			logger.Error("save converted image failed", "key", imageOutputPath+suffix, "error", err)
+			i.markDownloadFailed(logger, meta, config, fmt.Sprintf("save converted image failed: %v", err), false)
 			return
 		}
 	}
 	logger.Info("convert success, update local path")
+	if config.KeepOriginal {
+		i.keepOriginal(tempDownloadFilePath, imageInfo, &meta, logger)
+	}
 save:
-	_, err = os.Stat(imageOutputAbsolutePath + ".heic")
+	progress.setStage(downloadStageSaving)
+	_, err = i.storageService.Stat(imageOutputPath + outputExt)
 	if err != nil {
 		logger.Info("image not exists, skip")
+		i.markDownloadFailed(logger, meta, config, "converted image not found", false)
 		return
 	}
-	imageOutputPath = imageOutputPath + ".heic"
+	if object, err := i.storageService.Stat(imageOutputPath + outputExt); err == nil {
+		fileSize += object.Size
+	}
+	meta.Renditions = make(map[string]string)
+	for name, suffix := range renditionSuffixes {
+		if object, err := i.storageService.Stat(imageOutputPath + suffix); err == nil {
+			fileSize += object.Size
+			meta.Renditions[name] = imageOutputPath + suffix
+		}
+	}
+	if meta.OriginalSize != nil {
+		fileSize += *meta.OriginalSize
+	}
+	imageOutputPath = imageOutputPath + outputExt
 	meta.LocalPath = &imageOutputPath
+	meta.FileSize = &fileSize
 	if err := i.dbService.UpdateLocalPathForMeta(meta); err != nil {
 		logger.Error("update local path failed", "error", err)
 		return
 	}
+	i.quotaService.AddDiskBytes(sourceID, fileSize)
 	os.Remove(tempDownloadFilePath)
 }
+
+// tempDownloadPath 下载中的文件的路径, 不同版本分开保存, 避免续传时混在一起
+func (i *ImageDownloader) tempDownloadPath(hash string, candidate models.ImageURLCandidate) string {
+	if len(candidate.Variant) == 0 {
+		return path.Join(i.downloadTempPath, hash+path.Ext(candidate.URL))
+	}
+	variant := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, candidate.Variant)
+	return path.Join(i.downloadTempPath, hash+"."+variant+path.Ext(candidate.URL))
+}
+
+// isExpiredURLResponse 签名过期的地址通常返回 403 或 410
+func isExpiredURLResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone
+}
+
+// refreshImageURL 重新读取图片地址并保存到数据库中, 失败时返回 false
+func (i *ImageDownloader) refreshImageURL(meta *models.ImageMeta, refresher interfaces.ImageURLRefresher, logger *slog.Logger) bool {
+	candidates, err := refresher(*meta)
+	if err != nil {
+		logger.Warn("refresh image url failed", "error", err)
+		return false
+	}
+	meta.ImageURL = candidates[0].URL
+	meta.ImageURLCandidates = nil
+	if len(candidates) > 1 || len(candidates[0].Variant) != 0 {
+		meta.ImageURLCandidates = candidates
+	}
+	logger.Info("image url refreshed", "url", meta.ImageURL)
+	if err := i.dbService.UpdateImageURL(*meta); err != nil {
+		logger.Warn("save refreshed image url failed", "error", err)
+	}
+	return true
+}
+
+// isImageResponse 响应是否是可以保存的图片
+func isImageResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	return util.IsImageContentType(resp.Header.Get("Content-Type"))
+}
+
+// contentOutputPath 按内容保存的文件的路径(不含扩展名)
+func contentOutputPath(contentHash string) string {
+	return path.Join(contentHash[0:2], contentHash[2:4], contentHash[4:6], contentHash)
+}
+
+// keepOriginal 把下载的原始文件保存到存储中, 和转换之后的文件放在一起, 失败时只记录日志
+func (i *ImageDownloader) keepOriginal(tempPath string, imageInfo *util.ImageInfo, meta *models.ImageMeta, logger *slog.Logger) bool {
+	originalPath := contentOutputPath(imageInfo.SHA256) + ".orig" + util.ExtensionForMediaType(imageInfo.MediaType)
+	if err := i.storageService.PutFile(originalPath, tempPath, imageInfo.MediaType); err != nil {
+		logger.Error("keep original failed", "key", originalPath, "error", err)
+		return false
+	}
+	meta.OriginalPath = &originalPath
+	meta.OriginalSize = &imageInfo.Size
+	meta.OriginalMimeType = &imageInfo.MediaType
+	return true
+}
+
+// markDownloadFailed 记录失败原因, 按照 RetryBackoff 计算下次重试的时间, permanent 或者超过最大次数时不再自动重试
+func (i *ImageDownloader) markDownloadFailed(logger *slog.Logger, meta models.ImageMeta, config *config.ImageDownloaderConfig, reason string, permanent bool) {
+	var nextRetryAt *time.Time
+	if !permanent {
+		if next, ok := config.RetryBackoff.NextRetry(time.Now(), meta.DownloadAttempts+1); ok {
+			nextRetryAt = &next
+		}
+	}
+	if nextRetryAt != nil {
+		logger.Info("download failed, retry later", "reason", reason, "attempts", meta.DownloadAttempts+1, "nextRetryAt", *nextRetryAt)
+	} else {
+		logger.Info("download failed permanently", "reason", reason, "attempts", meta.DownloadAttempts+1)
+	}
+	if err := i.dbService.MarkMetaDownloadFailed(meta, reason, nextRetryAt); err != nil {
+		logger.Error("update download status failed", "error", err)
+	}
+}
+
+// expectedContentSize 返回下载完成之后文件应有的大小, 响应中没有相关信息时返回 -1
+func expectedContentSize(resp *http.Response, startDownloadPos int64) int64 {
+	if resp.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 100-199/200
+		contentRange := resp.Header.Get("Content-Range")
+		if idx := strings.LastIndex(contentRange, "/"); idx >= 0 {
+			if total, err := strconv.ParseInt(contentRange[idx+1:], 10, 64); err == nil {
+				return total
+			}
+		}
+		if resp.ContentLength >= 0 {
+			return startDownloadPos + resp.ContentLength
+		}
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// placeholderImageError 下载到的是占位图, 重试也不会得到原图
+type placeholderImageError string
+
+func (e placeholderImageError) Error() string {
+	return "placeholder image, sha256: " + string(e)
+}
+
+// validateImage 检查下载的文件是完整的图片, 并且不是占位图
+func validateImage(filePath string, config *config.ImageValidationConfig) (*util.ImageInfo, error) {
+	info, err := util.ValidateImageFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, placeholder := range config.PlaceholderHashes {
+		if strings.EqualFold(strings.TrimSpace(placeholder), info.SHA256) {
+			return nil, placeholderImageError(info.SHA256)
+		}
+	}
+	if info.Width > 0 && info.Height > 0 && (info.Width < config.MinWidth || info.Height < config.MinHeight) {
+		return nil, fmt.Errorf("image too small: %dx%d", info.Width, info.Height)
+	}
+	return info, nil
+}
@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/util"
+)
+
+// 全局限速在 bandwidthLimiters 中的 key
+const globalBandwidthKey = ""
+
+// bandwidthLimiter 一个限速器以及它的配置, override 不为空时优先于配置
+type bandwidthLimiter struct {
+	config   *config.BandwidthConfig
+	override *[2]int64
+	limiter  *util.RateLimiter
+}
+
+// bandwidthLimiters 全局和每个 source 的限速, 所有下载 worker 共享
+type bandwidthLimiters struct {
+	mtx      sync.Mutex
+	limiters map[string]*bandwidthLimiter
+}
+
+func newBandwidthLimiters() *bandwidthLimiters {
+	return &bandwidthLimiters{limiters: make(map[string]*bandwidthLimiter)}
+}
+func (b *bandwidthLimiters) add(key string, config *config.BandwidthConfig) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.limiters[key] = &bandwidthLimiter{config: config, limiter: util.NewRateLimiter()}
+}
+
+// reserve 从全局和 source 的限速器中取出 n 字节, 返回需要等待的时间
+func (b *bandwidthLimiters) reserve(sourceID string, n int64) time.Duration {
+	now := time.Now()
+	var delay time.Duration
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, key := range []string{globalBandwidthKey, sourceID} {
+		limiter, ok := b.limiters[key]
+		if !ok {
+			continue
+		}
+		limiter.apply(now)
+		delay = max(delay, limiter.limiter.Reserve(n))
+	}
+	return delay
+}
+func (l *bandwidthLimiter) apply(now time.Time) {
+	if l.override != nil {
+		l.limiter.SetLimit(l.override[0], l.override[1])
+		return
+	}
+	l.limiter.SetLimit(l.config.LimitAt(now))
+}
+func (b *bandwidthLimiters) setOverride(key string, override *[2]int64) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	limiter, ok := b.limiters[key]
+	if !ok {
+		return fmt.Errorf("source not found: %s", key)
+	}
+	limiter.override = override
+	limiter.apply(time.Now())
+	return nil
+}
+func (b *bandwidthLimiters) list() []models.BandwidthLimit {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	result := make([]models.BandwidthLimit, 0, len(b.limiters))
+	for key, limiter := range b.limiters {
+		limiter.apply(now)
+		rate, burst := limiter.limiter.Limit()
+		result = append(result, models.BandwidthLimit{
+			SourceID: key,
+			Rate:     rate,
+			Burst:    burst,
+			Override: limiter.override != nil,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SourceID < result[j].SourceID
+	})
+	return result
+}
+
+func (i *ImageDownloader) SetBandwidth(sourceID string, rate, burst int64) error {
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	return i.bandwidth.setOverride(sourceID, &[2]int64{rate, burst})
+}
+func (i *ImageDownloader) ResetBandwidth(sourceID string) error {
+	return i.bandwidth.setOverride(sourceID, nil)
+}
+func (i *ImageDownloader) GetBandwidth() []models.BandwidthLimit {
+	return i.bandwidth.list()
+}
+
+// waitOrStop 等待 d, 期间收到停止信号时返回 true
+func (i *ImageDownloader) waitOrStop(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-i.stopChain:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case <-i.stopChain:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// errDownloadStopped 限速等待时收到了停止信号
+var errDownloadStopped = errors.New("download stopped")
+
+// bandwidthReader 按全局和 source 的限速读取, 图片和预览图的下载都通过它读取响应
+// 等待时收到停止信号返回 errDownloadStopped, 调用方需要结束当前的 worker
+type bandwidthReader struct {
+	downloader *ImageDownloader
+	reader     io.Reader
+	sourceID   string
+	delay      time.Duration
+}
+
+func (i *ImageDownloader) limitReader(sourceID string, reader io.Reader) *bandwidthReader {
+	return &bandwidthReader{downloader: i, reader: reader, sourceID: sourceID}
+}
+func (r *bandwidthReader) Read(p []byte) (int, error) {
+	if r.downloader.waitOrStop(r.delay) {
+		return 0, errDownloadStopped
+	}
+	n, err := r.reader.Read(p)
+	r.delay = r.downloader.bandwidth.reserve(r.sourceID, int64(n))
+	return n, err
+}
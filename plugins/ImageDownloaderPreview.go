@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+)
+
+// 预览图的最大大小
+const maxPreviewSize = 10 * 1024 * 1024
+
+// findDuplicateByPreview 下载预览图, 查找相似的已下载的图片, 没有找到或者出错时返回 nil
+// 下载时收到停止信号时 exit 设置为 true
+func (i *ImageDownloader) findDuplicateByPreview(httpClient *http.Client, meta models.ImageMeta, config *config.ImageDownloaderConfig, logger *slog.Logger, exit *bool) *models.ImageMeta {
+	if !config.SkipDuplicatePreview.Enabled || meta.PreviewURL == nil || len(*meta.PreviewURL) == 0 {
+		return nil
+	}
+	previewPath := path.Join(i.downloadTempPath, meta.Hash()+".preview")
+	defer os.Remove(previewPath)
+	if err := i.downloadPreview(httpClient, *meta.PreviewURL, previewPath, meta.SourceID, config); err == errDownloadStopped {
+		*exit = true
+		return nil
+	} else if err != nil {
+		logger.Warn("download preview failed, download image directly", "url", *meta.PreviewURL, "error", err)
+		return nil
+	}
+	phash, err := i.imageConvertService.PerceptualHash(previewPath)
+	if err != nil {
+		return nil
+	}
+	similar, err := i.dbService.FindSimilarImage(int64(phash), config.SkipDuplicatePreview.MaxDistance)
+	if err != nil {
+		return nil
+	}
+	return similar
+}
+func (i *ImageDownloader) downloadPreview(httpClient *http.Client, url, output, sourceID string, config *config.ImageDownloaderConfig) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range config.Headers {
+		req.Header.Add(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// 和图片共用限速
+	written, err := io.Copy(file, io.LimitReader(i.limitReader(sourceID, resp.Body), maxPreviewSize))
+	i.quotaService.AddDownloadBytes(sourceID, written)
+	return err
+}
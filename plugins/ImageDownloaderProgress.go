@@ -0,0 +1,136 @@
+package plugins
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ywwzwb/imagespider/models"
+)
+
+const (
+	downloadStageWaiting     = "waiting"
+	downloadStageDownloading = "downloading"
+	downloadStageConverting  = "converting"
+	downloadStageSaving      = "saving"
+)
+
+// downloadProgress 一个正在处理的下载, worker 更新, API 读取
+type downloadProgress struct {
+	sourceID     string
+	metaID       string
+	url          string
+	startTime    time.Time
+	stage        atomic.Value
+	resumedFrom  atomic.Int64
+	bytesDone    atomic.Int64
+	bytesTotal   atomic.Int64
+	requestStart atomic.Int64 // 开始接收数据的时间, unix nano, 用于计算速度
+}
+
+func (p *downloadProgress) setStage(stage string) {
+	p.stage.Store(stage)
+}
+
+// beginTransfer 收到响应之后调用, total 未知时为 -1
+func (p *downloadProgress) beginTransfer(resumedFrom, total int64) {
+	p.resumedFrom.Store(resumedFrom)
+	p.bytesDone.Store(resumedFrom)
+	p.bytesTotal.Store(total)
+	p.requestStart.Store(time.Now().UnixNano())
+	p.setStage(downloadStageDownloading)
+}
+func (p *downloadProgress) addBytes(n int64) {
+	p.bytesDone.Add(n)
+}
+func (p *downloadProgress) snapshot(now time.Time) models.DownloadProgress {
+	result := models.DownloadProgress{
+		SourceID:    p.sourceID,
+		MetaID:      p.metaID,
+		URL:         p.url,
+		Stage:       p.stage.Load().(string),
+		StartTime:   p.startTime,
+		ResumedFrom: p.resumedFrom.Load(),
+		BytesDone:   p.bytesDone.Load(),
+		BytesTotal:  p.bytesTotal.Load(),
+	}
+	if start := p.requestStart.Load(); start > 0 {
+		if elapsed := now.Sub(time.Unix(0, start)); elapsed > 0 {
+			result.Speed = int64(float64(result.BytesDone-result.ResumedFrom) / elapsed.Seconds())
+		}
+	}
+	return result
+}
+
+// progressTracker 所有 worker 正在处理的下载
+type progressTracker struct {
+	mtx   sync.Mutex
+	items map[string]*downloadProgress
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{items: make(map[string]*downloadProgress)}
+}
+func (t *progressTracker) start(meta models.ImageMeta) *downloadProgress {
+	progress := &downloadProgress{
+		sourceID:  meta.SourceID,
+		metaID:    meta.ID,
+		url:       meta.ImageURL,
+		startTime: time.Now(),
+	}
+	progress.bytesTotal.Store(-1)
+	progress.setStage(downloadStageWaiting)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.items[meta.Hash()] = progress
+	return progress
+}
+func (t *progressTracker) finish(meta models.ImageMeta) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.items, meta.Hash())
+}
+func (t *progressTracker) list() []models.DownloadProgress {
+	now := time.Now()
+	t.mtx.Lock()
+	result := make([]models.DownloadProgress, 0, len(t.items))
+	for _, progress := range t.items {
+		result = append(result, progress.snapshot(now))
+	}
+	t.mtx.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime.Before(result[j].StartTime)
+	})
+	return result
+}
+func (q *downloadQueue) inflightCount() int {
+	q.inflightMtx.Lock()
+	defer q.inflightMtx.Unlock()
+	return len(q.inflight)
+}
+
+func (i *ImageDownloader) GetStatus() models.DownloaderStatus {
+	i.queuesMtx.Lock()
+	queues := make([]*downloadQueue, 0, len(i.queues))
+	for _, queue := range i.queues {
+		queues = append(queues, queue)
+	}
+	i.queuesMtx.Unlock()
+	sort.Slice(queues, func(a, b int) bool {
+		return queues[a].sourceID < queues[b].sourceID
+	})
+	status := models.DownloaderStatus{
+		Sources:   make([]models.SourceDownloadStatus, 0, len(queues)),
+		Downloads: i.progress.list(),
+	}
+	for _, queue := range queues {
+		depth, _ := i.dbService.CountMetaToDownload(queue.sourceID)
+		status.Sources = append(status.Sources, models.SourceDownloadStatus{
+			SourceID:    queue.sourceID,
+			Parallelism: queue.parallelism(),
+			InFlight:    queue.inflightCount(),
+			QueueDepth:  depth,
+		})
+	}
+	return status
+}
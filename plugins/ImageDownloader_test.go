@@ -0,0 +1,293 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+	"ywwzwb/imagespider/util"
+)
+
+// fakeImageConvertService 不转换, 直接复制下载的文件
+type fakeImageConvertService struct {
+	interfaces.IImageConvertService
+}
+
+func (c *fakeImageConvertService) ConvertHEIC(sourceID, input, output string) error {
+	return copyFile(input, output)
+}
+func (c *fakeImageConvertService) OutputExtension(sourceID string, mediaType models.MediaType, sourceMediaType string) string {
+	return ".heic"
+}
+func (c *fakeImageConvertService) RenditionSuffixes(sourceID string) map[string]string {
+	return map[string]string{}
+}
+func (c *fakeImageConvertService) PerceptualHash(input string) (uint64, error) {
+	return 0, errConvertNotSupported
+}
+
+type fixtureDownloader struct {
+	*ImageDownloader
+	db      *fakeDBService
+	quota   *fakeQuotaService
+	storage *localStorage
+	client  *http.Client
+	config  *config.ImageDownloaderConfig
+}
+
+// newFixtureDownloader 回放 testdata/fixtures/downloader 中录制的图片
+// 201.jpg, 202-sample.jpg, 203.jpg 是图片, 202-orig.png 返回 404, 203.jpg 录制了 bytes=100- 的续传请求
+func newFixtureDownloader(t *testing.T) *fixtureDownloader {
+	t.Helper()
+	useHTTPFixture(t, "downloader")
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader := newImageDownloader()
+	downloader.downloadTempPath = t.TempDir()
+	f := &fixtureDownloader{
+		ImageDownloader: downloader,
+		db:              newFakeDBService(),
+		quota:           &fakeQuotaService{},
+		storage:         storage,
+		client:          util.NewHTTPClient(1),
+		config:          &config.ImageDownloaderConfig{ErrorRetryMaxCount: 2},
+	}
+	downloader.dbService = f.db
+	downloader.quotaService = f.quota
+	downloader.storageService = storage
+	downloader.imageConvertService = &fakeImageConvertService{}
+	return f
+}
+
+// fetch 直接请求录制的图片
+func (f *fixtureDownloader) fetch(t *testing.T, url string) []byte {
+	t.Helper()
+	resp, err := f.client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// download 下载并检查保存的文件和 expected 相同
+func (f *fixtureDownloader) download(t *testing.T, meta models.ImageMeta, expected []byte) models.ImageMeta {
+	t.Helper()
+	exit := false
+	f.downloadImage(f.client, fixtureSourceID, meta, f.config, nil, &exit)
+	if status := f.db.statuses[meta.ID]; status != models.DownloadStatusDone {
+		t.Fatalf("expected done, got %s, reason: %s", status, f.db.failures[meta.ID])
+	}
+	saved := f.db.metas[meta.ID]
+	sum := sha256.Sum256(expected)
+	contentHash := hex.EncodeToString(sum[:])
+	if saved.ContentHash == nil || *saved.ContentHash != contentHash {
+		t.Fatalf("unexpected content hash: %v", saved.ContentHash)
+	}
+	if saved.LocalPath == nil || *saved.LocalPath != contentOutputPath(contentHash)+".heic" {
+		t.Fatalf("unexpected local path: %v", saved.LocalPath)
+	}
+	reader, err := f.storage.Get(*saved.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(expected) {
+		t.Fatalf("saved content mismatch, size: %d, expected: %d", len(content), len(expected))
+	}
+	if saved.FileSize == nil || *saved.FileSize != int64(len(expected)) {
+		t.Fatalf("unexpected file size: %v", saved.FileSize)
+	}
+	return saved
+}
+
+func TestImageDownloaderReplay(t *testing.T) {
+	f := newFixtureDownloader(t)
+	expected := f.fetch(t, "https://img.example.com/201.jpg")
+	meta := models.ImageMeta{SourceID: fixtureSourceID, ID: "201", ImageURL: "https://img.example.com/201.jpg"}
+	saved := f.download(t, meta, expected)
+	if saved.Width == nil || *saved.Width != 32 || saved.Height == nil || *saved.Height != 24 {
+		t.Fatalf("unexpected size: %v x %v", saved.Width, saved.Height)
+	}
+	if f.quota.downloadBytes != int64(len(expected)) {
+		t.Fatalf("expected %d bytes downloaded, got %d", len(expected), f.quota.downloadBytes)
+	}
+	if f.quota.diskBytes != int64(len(expected)) {
+		t.Fatalf("expected %d disk bytes, got %d", len(expected), f.quota.diskBytes)
+	}
+}
+
+func TestImageDownloaderVariantFallback(t *testing.T) {
+	f := newFixtureDownloader(t)
+	expected := f.fetch(t, "https://img.example.com/202-sample.jpg")
+	meta := models.ImageMeta{
+		SourceID: fixtureSourceID,
+		ID:       "202",
+		ImageURL: "https://img.example.com/202-orig.png",
+		ImageURLCandidates: []models.ImageURLCandidate{
+			{Variant: "original", URL: "https://img.example.com/202-orig.png"},
+			{Variant: "sample", URL: "https://img.example.com/202-sample.jpg"},
+		},
+	}
+	saved := f.download(t, meta, expected)
+	if saved.ImageVariant == nil || *saved.ImageVariant != "sample" {
+		t.Fatalf("expected sample variant, got %v", saved.ImageVariant)
+	}
+}
+
+func TestImageDownloaderResume(t *testing.T) {
+	cases := []struct {
+		name    string
+		id      string
+		partial int
+		resumed bool
+	}{
+		// 录制了续传的请求, 只下载剩余的部分
+		{"recorded range", "203", 100, true},
+		// 没有录制的续传请求返回 416, 删除已下载的部分之后从头下载
+		{"unrecorded range", "201", 50, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFixtureDownloader(t)
+			url := "https://img.example.com/" + c.id + ".jpg"
+			expected := f.fetch(t, url)
+			meta := models.ImageMeta{SourceID: fixtureSourceID, ID: c.id, ImageURL: url}
+			partialPath := f.tempDownloadPath(meta.Hash(), meta.Candidates()[0]) + ".downloading"
+			if err := os.WriteFile(partialPath, expected[:c.partial], 0644); err != nil {
+				t.Fatal(err)
+			}
+			f.download(t, meta, expected)
+			downloaded := int64(len(expected))
+			if c.resumed {
+				downloaded -= int64(c.partial)
+			}
+			if f.quota.downloadBytes != downloaded {
+				t.Fatalf("expected %d bytes downloaded, got %d", downloaded, f.quota.downloadBytes)
+			}
+			if files, _ := filepath.Glob(filepath.Join(f.downloadTempPath, "*")); len(files) != 0 {
+				t.Fatalf("temp files left: %v", files)
+			}
+		})
+	}
+}
+
+func TestImageDownloaderPreviewBandwidth(t *testing.T) {
+	f := newFixtureDownloader(t)
+	expected := f.fetch(t, "https://img.example.com/201.jpg")
+	// 限速 1 byte/s, 预览图小于 burst 不需要等待, 但是之后的下载需要等待预览图用掉的令牌
+	f.bandwidth.add(fixtureSourceID, &config.BandwidthConfig{})
+	if err := f.SetBandwidth(fixtureSourceID, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, burst := f.bandwidth.limiters[fixtureSourceID].limiter.Limit()
+	output := filepath.Join(t.TempDir(), "201.preview")
+	if err := f.downloadPreview(f.client, "https://img.example.com/201.jpg", output, fixtureSourceID, f.config); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(output); err != nil || string(content) != string(expected) {
+		t.Fatalf("unexpected preview: %d bytes, %v", len(content), err)
+	}
+	if f.quota.downloadBytes != int64(len(expected)) {
+		t.Fatalf("expected %d bytes downloaded, got %d", len(expected), f.quota.downloadBytes)
+	}
+	if delay := f.bandwidth.reserve(fixtureSourceID, burst); delay <= 0 {
+		t.Fatalf("preview download did not use the bandwidth limiter")
+	}
+}
+
+// brokenBodyTransport 返回的响应读取 size 字节之后出错
+type brokenBodyTransport struct {
+	size int
+}
+
+func (t brokenBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       io.NopCloser(io.MultiReader(bytes.NewReader(make([]byte, t.size)), iotest.ErrReader(errors.New("connection reset")))),
+		Request:    req,
+	}, nil
+}
+
+func TestImageDownloaderBodyError(t *testing.T) {
+	f := newFixtureDownloader(t)
+	meta := models.ImageMeta{SourceID: fixtureSourceID, ID: "204", ImageURL: "https://img.example.com/204.jpg"}
+	exit := false
+	f.downloadImage(&http.Client{Transport: brokenBodyTransport{size: 10000}}, fixtureSourceID, meta, f.config, nil, &exit)
+	if reason := f.db.failures[meta.ID]; !strings.Contains(reason, "connection reset") {
+		t.Fatalf("expected read error, got status %s, reason: %q", f.db.statuses[meta.ID], reason)
+	}
+	if f.quota.downloadBytes != 10000 {
+		t.Fatalf("expected 10000 bytes downloaded, got %d", f.quota.downloadBytes)
+	}
+}
+
+// statusTransport 返回 status, 记录没有关闭的响应数量
+type statusTransport struct {
+	status   int
+	requests int
+	open     int
+}
+type trackedBody struct {
+	io.Reader
+	transport *statusTransport
+	closed    bool
+}
+
+func (b *trackedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.transport.open--
+	}
+	return nil
+}
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	t.open++
+	return &http.Response{
+		StatusCode: t.status,
+		Status:     http.StatusText(t.status),
+		Header:     make(http.Header),
+		Body:       &trackedBody{Reader: strings.NewReader("error"), transport: t},
+		Request:    req,
+	}, nil
+}
+
+func TestImageDownloaderRetryClosesBody(t *testing.T) {
+	f := newFixtureDownloader(t)
+	meta := models.ImageMeta{SourceID: fixtureSourceID, ID: "205", ImageURL: "https://img.example.com/205.jpg"}
+	transport := &statusTransport{status: http.StatusInternalServerError}
+	exit := false
+	f.downloadImage(&http.Client{Transport: transport}, fixtureSourceID, meta, f.config, nil, &exit)
+	if transport.requests != int(f.config.ErrorRetryMaxCount) {
+		t.Fatalf("expected %d requests, got %d", f.config.ErrorRetryMaxCount, transport.requests)
+	}
+	if transport.open != 0 {
+		t.Fatalf("%d response bodies not closed", transport.open)
+	}
+	if reason := f.db.failures[meta.ID]; !strings.Contains(reason, "unexpected status") {
+		t.Fatalf("unexpected failure reason: %q", reason)
+	}
+}
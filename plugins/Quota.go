@@ -0,0 +1,178 @@
+package plugins
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+)
+
+const QuotaPluginID string = "Quota"
+
+// 定期从数据库重新读取占用的空间, 文件删除或者 blob 释放的时候内存中的值不会减少
+const diskUsageRefreshInterval = 10 * time.Minute
+
+// sourceUsage 一个 source 当天的用量, 从数据库加载, 之后在内存中累加, 同时写回数据库
+type sourceUsage struct {
+	day             string
+	posts           int64
+	downloadBytes   int64
+	diskBytes       int64
+	diskRefreshedAt time.Time
+}
+
+type Quota struct {
+	app       interfaces.IApplication
+	dbService interfaces.IDBService
+	usageMtx  sync.Mutex
+	usage     map[string]*sourceUsage
+}
+
+func newQuota() *Quota {
+	quota := Quota{}
+	quota.usage = make(map[string]*sourceUsage)
+	return &quota
+}
+
+func init() {
+	quota := newQuota()
+	interfaces.Plugins[quota.ID()] = quota
+}
+
+func (q *Quota) Name() string {
+	return "Quota"
+}
+func (q *Quota) ID() string {
+	return QuotaPluginID
+}
+func (q *Quota) Load(app interfaces.IApplication) error {
+	q.app = app
+	dbService, err := app.GetService(q.ID(), DBPluginID, interfaces.DBServiceID)
+	if err != nil {
+		slog.Error("get db service failed", "error", err)
+		return err
+	}
+	q.dbService = dbService.(interfaces.IDBService)
+	return nil
+}
+func (q *Quota) Unload() {
+}
+func (q *Quota) GetService(serviceID interfaces.ServiceID) (interfaces.IService, error) {
+	switch serviceID {
+	case interfaces.QuotaServiceID:
+		return q, nil
+	}
+	return nil, fmt.Errorf("service not found")
+}
+func (q *Quota) quotaConfig(sourceID string) config.QuotaConfig {
+	spiderConfig, ok := q.app.GetAppConfig().Spiders[sourceID]
+	if !ok {
+		return config.QuotaConfig{}
+	}
+	return spiderConfig.Quota
+}
+
+// currentUsage 返回当天的用量, 跨天时重新从数据库加载, 占用的空间定期重新加载, 调用方需要持有 usageMtx
+func (q *Quota) currentUsage(sourceID string) *sourceUsage {
+	now := time.Now()
+	day := now.Format(time.DateOnly)
+	usage, ok := q.usage[sourceID]
+	if !ok || usage.day != day {
+		usage = &sourceUsage{day: day}
+		posts, downloadBytes, err := q.dbService.GetSourceUsage(sourceID, now)
+		if err == nil {
+			usage.posts = posts
+			usage.downloadBytes = downloadBytes
+		}
+		q.usage[sourceID] = usage
+	}
+	if now.Sub(usage.diskRefreshedAt) >= diskUsageRefreshInterval {
+		q.loadDiskUsage(sourceID, usage, now)
+	}
+	return usage
+}
+
+// loadDiskUsage 从数据库读取占用的空间, 失败时保留之前的值, 等下次刷新时再试, 调用方需要持有 usageMtx
+func (q *Quota) loadDiskUsage(sourceID string, usage *sourceUsage, now time.Time) {
+	usage.diskRefreshedAt = now
+	if diskBytes, err := q.dbService.GetSourceDiskUsage(sourceID); err == nil {
+		usage.diskBytes = diskBytes
+	}
+}
+func (q *Quota) AllowNewPost(sourceID string) bool {
+	quotaConfig := q.quotaConfig(sourceID)
+	if quotaConfig.MaxPostsPerDay <= 0 {
+		return true
+	}
+	q.usageMtx.Lock()
+	defer q.usageMtx.Unlock()
+	return q.currentUsage(sourceID).posts < quotaConfig.MaxPostsPerDay
+}
+func (q *Quota) AddPost(sourceID string) {
+	q.usageMtx.Lock()
+	q.currentUsage(sourceID).posts++
+	q.usageMtx.Unlock()
+	q.dbService.AddSourceUsage(sourceID, time.Now(), 1, 0)
+}
+func (q *Quota) AllowDownload(sourceID string) bool {
+	quotaConfig := q.quotaConfig(sourceID)
+	if quotaConfig.MaxDownloadBytesPerDay <= 0 && quotaConfig.MaxDiskBytes <= 0 {
+		return true
+	}
+	q.usageMtx.Lock()
+	defer q.usageMtx.Unlock()
+	usage := q.currentUsage(sourceID)
+	if quotaConfig.MaxDownloadBytesPerDay > 0 && usage.downloadBytes >= quotaConfig.MaxDownloadBytesPerDay {
+		return false
+	}
+	if quotaConfig.MaxDiskBytes > 0 && usage.diskBytes >= quotaConfig.MaxDiskBytes {
+		return false
+	}
+	return true
+}
+func (q *Quota) AddDownloadBytes(sourceID string, size int64) {
+	if size <= 0 {
+		return
+	}
+	q.usageMtx.Lock()
+	q.currentUsage(sourceID).downloadBytes += size
+	q.usageMtx.Unlock()
+	q.dbService.AddSourceUsage(sourceID, time.Now(), 0, size)
+}
+func (q *Quota) AddDiskBytes(sourceID string, size int64) {
+	q.usageMtx.Lock()
+	defer q.usageMtx.Unlock()
+	q.currentUsage(sourceID).diskBytes += size
+}
+func (q *Quota) RefreshDiskUsage(sourceID string) {
+	q.usageMtx.Lock()
+	defer q.usageMtx.Unlock()
+	usage, ok := q.usage[sourceID]
+	if !ok {
+		// 还没有加载过, 下次使用时会从数据库读取
+		return
+	}
+	q.loadDiskUsage(sourceID, usage, time.Now())
+}
+func (q *Quota) GetUsage(sourceID string) (*models.QuotaUsage, error) {
+	if _, ok := q.app.GetAppConfig().Spiders[sourceID]; !ok {
+		return nil, NotFound
+	}
+	quotaConfig := q.quotaConfig(sourceID)
+	q.usageMtx.Lock()
+	defer q.usageMtx.Unlock()
+	usage := q.currentUsage(sourceID)
+	return &models.QuotaUsage{
+		SourceID:               sourceID,
+		Day:                    usage.day,
+		Posts:                  usage.posts,
+		DownloadBytes:          usage.downloadBytes,
+		DiskBytes:              usage.diskBytes,
+		MaxPostsPerDay:         quotaConfig.MaxPostsPerDay,
+		MaxDownloadBytesPerDay: quotaConfig.MaxDownloadBytesPerDay,
+		MaxDiskBytes:           quotaConfig.MaxDiskBytes,
+	}, nil
+}
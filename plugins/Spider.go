@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +26,7 @@ const (
 	SpiderErrorSuccess spiderError = iota
 	SpiderErrorStop
 	SpiderErrorError
+	SpiderErrorQuotaExceeded
 )
 
 type spiderState int
@@ -36,6 +37,7 @@ const (
 	spiderStateError
 	spiderStateFinished
 	spiderStateEarlyStop
+	spiderStateQuotaExceeded
 )
 
 func (s spiderState) Equals(other common.State) bool {
@@ -52,6 +54,7 @@ const (
 	spiderEventTypeError
 	spiderEventTypeFinish
 	spiderEventTypeEarlyStop
+	spiderEventTypeQuotaExceeded
 )
 
 type spiderEvent struct {
@@ -70,6 +73,8 @@ func (e spiderEvent) Equals(other common.Event) bool {
 type spiderContext struct {
 	hasNewData   bool
 	oldDataCount int
+	// 上次因为配额中断, 第一页中已经抓过的数据不代表没有新数据
+	resumeFromQuota bool
 }
 
 func (e spiderError) Error() string {
@@ -78,6 +83,8 @@ func (e spiderError) Error() string {
 		return "success"
 	case SpiderErrorStop:
 		return "stop spider"
+	case SpiderErrorQuotaExceeded:
+		return "quota exceeded"
 	default:
 		return "unknown spider error"
 	}
@@ -90,6 +97,7 @@ type Spider struct {
 	stopFinishChain  chan bool
 	dbService        interfaces.IDBService
 	dataCheckService interfaces.IDataCheckerService
+	quotaService     interfaces.IQuotaService
 }
 
 func newSpider() *Spider {
@@ -137,8 +145,15 @@ func (s *Spider) Load(app interfaces.IApplication) error {
 	}
 	s.dataCheckService = dataCheckService.(interfaces.IDataCheckerService)
 
+	quotaService, err := app.GetService(s.ID(), QuotaPluginID, interfaces.QuotaServiceID)
+	if err != nil {
+		slog.Error("get quota service failed", "error", err)
+		return err
+	}
+	s.quotaService = quotaService.(interfaces.IQuotaService)
+
 	for _, spiderConfig := range s.config {
-		imageDownloaderService.AddConfig(spiderConfig.ID, &spiderConfig.ImageDownloaderConfig)
+		imageDownloaderService.AddConfig(spiderConfig.ID, &spiderConfig.ImageDownloaderConfig, s.imageURLRefresher(spiderConfig))
 		go s.runSpider(spiderConfig)
 	}
 	return nil
@@ -167,14 +182,26 @@ func (s *Spider) runSpider(spiderConfig *config.SpiderConfig) {
 	for {
 		// 抓取所有页面
 		var page *int64
+		resumeFromQuota := false
 		for page = s.app.GetRuntimeConfig().StackTop(spiderConfig.ID); page != nil; page = s.app.GetRuntimeConfig().StackTop(spiderConfig.ID) {
 			logger.Debug("page fetching", "start", page)
-			err := s.fetchListFromPage(spiderConfig, *page)
+			err := s.fetchListFromPage(spiderConfig, *page, resumeFromQuota)
 			if err == SpiderErrorStop {
 				// 结束了
 				logger.Info("spider stopped")
 				goto finalize
+			} else if err == SpiderErrorQuotaExceeded {
+				// 配额用完了, 保留页面栈, 等配额恢复后从中断的地方继续
+				resumeFromQuota = true
+				logger.Info("post quota exceeded, wait for quota")
+				select {
+				case <-s.stopChain:
+					logger.Info("stop spider")
+					goto finalize
+				case <-time.After(quotaWaitDuration(spiderConfig)):
+				}
 			} else if err == SpiderErrorSuccess {
+				resumeFromQuota = false
 				logger.Debug("page finish", "start", page)
 			} else {
 				logger.Debug("page error", "start", page)
@@ -197,10 +224,22 @@ finalize:
 	logger.Info("stop spider finish")
 
 }
-func (s *Spider) fetchListFromPage(spiderConfig *config.SpiderConfig, starPage int64) spiderError {
+
+// quotaWaitDuration 配额用完后等待的时间, 刷新间隔和到第二天的时间中较短的一个
+func quotaWaitDuration(spiderConfig *config.SpiderConfig) time.Duration {
+	now := time.Now()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	wait := tomorrow.Sub(now)
+	refresh := time.Duration(spiderConfig.MetaDownloaderConfig.RefreshInterval) * time.Second
+	if refresh > 0 && refresh < wait {
+		wait = refresh
+	}
+	return wait
+}
+func (s *Spider) fetchListFromPage(spiderConfig *config.SpiderConfig, starPage int64, resumeFromQuota bool) spiderError {
 	slog.Info("fetch list from page", "page", starPage)
 	sm := common.NewStateMachine(spiderStateInit)
-	c := &spiderContext{}
+	c := &spiderContext{resumeFromQuota: resumeFromQuota}
 	sm.AddTransactions([]common.State{spiderStateInit, spiderStateRunning},
 		spiderStateRunning,
 		spiderEvent{eventType: spiderEventTypeGetPage}, func(event common.Event, context common.Context) bool {
@@ -237,6 +276,14 @@ func (s *Spider) fetchListFromPage(spiderConfig *config.SpiderConfig, starPage i
 		func(event common.Event, context common.Context) {
 			slog.Debug("fetch list state early stop")
 		})
+	sm.AddTransaction(spiderStateRunning,
+		spiderStateQuotaExceeded,
+		spiderEvent{eventType: spiderEventTypeQuotaExceeded}, func(event common.Event, context common.Context) bool {
+			return true
+		},
+		func(event common.Event, context common.Context) {
+			slog.Debug("fetch list state quota exceeded")
+		})
 	sm.Handle(spiderEvent{eventType: spiderEventTypeGetPage, page: starPage + 1}, c)
 	slog.Info("fetch list finish", "page", starPage, "state", sm.CurrentState)
 	switch sm.CurrentState {
@@ -244,6 +291,8 @@ func (s *Spider) fetchListFromPage(spiderConfig *config.SpiderConfig, starPage i
 		return SpiderErrorStop
 	case spiderStateFinished:
 		return SpiderErrorSuccess
+	case spiderStateQuotaExceeded:
+		return SpiderErrorQuotaExceeded
 	default:
 		return SpiderErrorError
 	}
@@ -256,15 +305,7 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 		return
 	default:
 	}
-	transport := &http.Transport{
-		// 设置连接超时时间
-		DialContext: (&net.Dialer{
-			Timeout: time.Duration(spiderConfig.MetaDownloaderConfig.ConnectTimeout) * time.Second,
-		}).DialContext,
-	}
-	httpClient := &http.Client{
-		Transport: transport,
-	}
+	httpClient := util.NewHTTPClient(spiderConfig.MetaDownloaderConfig.ConnectTimeout)
 	var resp *http.Response
 	var err error
 	url := strings.ReplaceAll(spiderConfig.ListParser.URLTemplate, "__PAGE__", fmt.Sprintf("%d", event.page))
@@ -301,12 +342,13 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 		return
 	}
 	defer resp.Body.Close()
+	logger = logger.With("final url", resp.Request.URL.String())
 	if resp.StatusCode != 200 {
 		logger.Error("fetch page failed", "status", resp.StatusCode)
 		sm.Handle(spiderEvent{eventType: spiderEventTypeError, error: fmt.Errorf("fetch page failed, status:%d", resp.StatusCode)}, context)
 		return
 	}
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	doc, err := util.NewDocumentFromResponse(resp, spiderConfig.MetaDownloaderConfig.Charset)
 	if err != nil {
 		logger.Error("parse html failed", "error", err)
 		sm.Handle(spiderEvent{eventType: spiderEventTypeError, error: err}, context)
@@ -356,7 +398,7 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 		return
 	}
 	nextPageParser := util.NewParser(&spiderConfig.ListParser.NextPage)
-	nextPageList, err := nextPageParser.Parse(doc)
+	nextPageList, err := nextPageParser.ParseURL(doc)
 	lastPage := false
 	if len(nextPageList) == 0 || err != nil {
 		lastPage = true
@@ -382,7 +424,7 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 				}
 			}
 			// 之前没有新数据?
-			if page == 1 {
+			if page == 1 && !context.resumeFromQuota {
 				// 如果是第一页, 那就直接完成了(最新的一页没有任何新数据)
 				logger.Info("this task finish cause first page has no new data", "id idx", ididx)
 				sm.Handle(spiderEvent{eventType: spiderEventTypeFinish}, context)
@@ -392,6 +434,11 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 			continue
 		}
 		// 新数据
+		if !s.quotaService.AllowNewPost(spiderConfig.ID) {
+			logger.Info("post quota exceeded, stop fetching", "id", id)
+			sm.Handle(spiderEvent{eventType: spiderEventTypeQuotaExceeded}, context)
+			return
+		}
 		// 获取元数据
 		logger.Debug("new data", "id", id)
 		if err := s.fetchMeta(httpClient, id, context, sm, spiderConfig); err != nil {
@@ -414,6 +461,34 @@ func (s *Spider) fetchListStateRun(event spiderEvent, context *spiderContext, sm
 		sm.Handle(spiderEvent{eventType: spiderEventTypeGetPage, page: page + 1}, context)
 	}
 }
+
+// imageURLRefresher 返回重新读取 meta 页面解析图片地址的函数, 只请求一次, 不修改其他信息
+func (s *Spider) imageURLRefresher(spiderConfig *config.SpiderConfig) interfaces.ImageURLRefresher {
+	httpClient := util.NewHTTPClient(spiderConfig.MetaDownloaderConfig.ConnectTimeout)
+	return func(meta models.ImageMeta) ([]models.ImageURLCandidate, error) {
+		url := strings.ReplaceAll(spiderConfig.MetaParser.URLTemplate, "__ID__", meta.ID)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range spiderConfig.MetaParser.Headers {
+			req.Header.Add(k, v)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("fetch meta failed, status:%d", resp.StatusCode)
+		}
+		doc, err := util.NewDocumentFromResponse(resp, spiderConfig.MetaDownloaderConfig.Charset)
+		if err != nil {
+			return nil, err
+		}
+		return parseImageURLCandidates(doc, &spiderConfig.MetaParser)
+	}
+}
 func (s *Spider) fetchMeta(httpClient *http.Client, id string, context *spiderContext, sm *common.StateMachine, spiderConfig *config.SpiderConfig) error {
 	select {
 	case <-s.stopChain:
@@ -455,12 +530,13 @@ func (s *Spider) fetchMeta(httpClient *http.Client, id string, context *spiderCo
 		return err
 	}
 	defer resp.Body.Close()
+	logger = logger.With("final url", resp.Request.URL.String())
 	if resp.StatusCode != 200 {
 		logger.Error("fetch meta failed", "status", resp.StatusCode)
 		return fmt.Errorf("fetch meta failed, status:%d", resp.StatusCode)
 	}
 	var meta models.ImageMeta
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	doc, err := util.NewDocumentFromResponse(resp, spiderConfig.MetaDownloaderConfig.Charset)
 	if err != nil {
 		logger.Error("parse html failed", "error", err)
 		return err
@@ -474,13 +550,21 @@ func (s *Spider) fetchMeta(httpClient *http.Client, id string, context *spiderCo
 		}
 		meta.Tags = append(meta.Tags, tagList...)
 	}
-	imageURLParser := util.NewParser(&spiderConfig.MetaParser.ImageURL)
-	imageURLList, err := imageURLParser.Parse(doc)
-	if len(imageURLList) == 0 || err != nil {
+	candidates, err := parseImageURLCandidates(doc, &spiderConfig.MetaParser)
+	if err != nil {
 		logger.Error("get image failed", "error", err)
 		return err
 	}
-	meta.ImageURL = imageURLList[0]
+	meta.ImageURL = candidates[0].URL
+	if len(spiderConfig.MetaParser.ImageURLs) != 0 {
+		meta.ImageURLCandidates = candidates
+	}
+	if len(spiderConfig.MetaParser.PreviewURL.Selector) != 0 {
+		previewURLParser := util.NewParser(&spiderConfig.MetaParser.PreviewURL)
+		if previewURLList, err := previewURLParser.ParseURL(doc); err == nil && len(previewURLList) != 0 {
+			meta.PreviewURL = &previewURLList[0]
+		}
+	}
 	postTimeParser := util.NewParser(&spiderConfig.MetaParser.PostTime)
 	postTimeList, err := postTimeParser.Parse(doc)
 	if len(postTimeList) == 0 || err != nil {
@@ -498,6 +582,40 @@ func (s *Spider) fetchMeta(httpClient *http.Client, id string, context *spiderCo
 	context.oldDataCount = 0
 	context.hasNewData = true
 	logger.Debug("save new meta", "meta", meta)
-	s.dbService.InsertMeta(meta)
+	if err := s.dbService.InsertMeta(meta); err == nil {
+		s.quotaService.AddPost(spiderConfig.ID)
+	}
 	return nil
 }
+
+// parseImageURLCandidates 按优先级解析图片的各个版本的地址, 没有配置 ImageURLs 时只解析 ImageURL
+func parseImageURLCandidates(doc *goquery.Document, metaParser *config.MetaParser) ([]models.ImageURLCandidate, error) {
+	if len(metaParser.ImageURLs) == 0 {
+		imageURLList, err := util.NewParser(&metaParser.ImageURL).ParseURL(doc)
+		if err != nil {
+			return nil, err
+		}
+		if len(imageURLList) == 0 {
+			return nil, fmt.Errorf("image url not found")
+		}
+		return []models.ImageURLCandidate{{URL: imageURLList[0]}}, nil
+	}
+	candidates := make([]models.ImageURLCandidate, 0, len(metaParser.ImageURLs))
+	for _, imageURLParser := range metaParser.ImageURLs {
+		imageURLList, err := util.NewParser(&imageURLParser.Parser).ParseURL(doc)
+		if err != nil || len(imageURLList) == 0 {
+			continue
+		}
+		// 部分页面上不同版本使用同一个地址
+		duplicated := slices.ContainsFunc(candidates, func(candidate models.ImageURLCandidate) bool {
+			return candidate.URL == imageURLList[0]
+		})
+		if !duplicated {
+			candidates = append(candidates, models.ImageURLCandidate{Variant: imageURLParser.Variant, URL: imageURLList[0]})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("image url not found")
+	}
+	return candidates, nil
+}
@@ -0,0 +1,143 @@
+package plugins
+
+import (
+	"slices"
+	"testing"
+	"time"
+	"ywwzwb/imagespider/models/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 和 testdata/fixtures/spider 中录制的页面对应
+// 第 1 页: 105 104 103, 第 2 页: 102 101, 第 2 页是最后一页
+const fixtureSpiderConfig = `
+id: fixture
+metaDownloader:
+  errorRetryInterval: 0
+  errorRetryMaxCount: 1
+listParser:
+  urlTemplate: https://example.com/list?page=__PAGE__
+  id:
+    selector: a.post
+    value: innertext
+  pageNum:
+    selector: span.page
+    value: innertext
+  nextPage:
+    selector: a.next
+    value: href
+  sameIDtolerance: 1
+metaParser:
+  urlTemplate: https://example.com/post/__ID__
+  tags:
+    - selector: a.tag
+      value: innertext
+  imageURL:
+    selector: img#image
+    value: src
+  postTime:
+    selector: time
+    value: innertext
+    ext:
+      format: "2006-01-02 15:04:05"
+`
+
+func newFixtureSpider(t *testing.T, db *fakeDBService, quota *fakeQuotaService) (*Spider, *config.SpiderConfig) {
+	t.Helper()
+	useHTTPFixture(t, "spider")
+	spiderConfig := &config.SpiderConfig{}
+	if err := yaml.Unmarshal([]byte(fixtureSpiderConfig), spiderConfig); err != nil {
+		t.Fatal(err)
+	}
+	spider := newSpider()
+	spider.stopChain = make(chan bool)
+	spider.app = newFakeApplication(t)
+	spider.dbService = db
+	spider.quotaService = quota
+	return spider, spiderConfig
+}
+
+func TestSpiderListPaging(t *testing.T) {
+	db := newFakeDBService()
+	spider, spiderConfig := newFixtureSpider(t, db, &fakeQuotaService{})
+	spider.app.GetRuntimeConfig().AppendStack(spiderConfig.ID, 0)
+	if err := spider.fetchListFromPage(spiderConfig, 0, false); err != SpiderErrorSuccess {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if expected := []string{"105", "104", "103", "102", "101"}; !slices.Equal(db.inserted, expected) {
+		t.Fatalf("expected %v inserted, got %v", expected, db.inserted)
+	}
+	meta := db.metas["103"]
+	if meta.ImageURL != "https://img.example.com/103.jpg" {
+		t.Fatalf("unexpected image url: %s", meta.ImageURL)
+	}
+	if !slices.Equal(meta.Tags, []string{"tag_103", "common"}) {
+		t.Fatalf("unexpected tags: %v", meta.Tags)
+	}
+	if !meta.PostTime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected post time: %v", meta.PostTime)
+	}
+	// 最后一页完成之后出栈
+	if top := spider.app.GetRuntimeConfig().StackTop(spiderConfig.ID); top != nil {
+		t.Fatalf("expected empty stack, got top %d", *top)
+	}
+}
+
+func TestSpiderSameIDTolerance(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing []string
+		inserted []string
+	}{
+		// 104 是第一条旧数据, 在容忍范围内, 103 之后停止, 不再请求第 2 页
+		{"stop after tolerance", []string{"104", "103", "102", "101"}, []string{"105"}},
+		// 旧数据之间又出现新数据时重新计数
+		{"reset on new data", []string{"104", "102"}, []string{"105", "103", "101"}},
+		// 第一页的第一条就是旧数据, 没有新数据
+		{"first page has no new data", []string{"105"}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newFakeDBService(c.existing...)
+			spider, spiderConfig := newFixtureSpider(t, db, &fakeQuotaService{})
+			spider.app.GetRuntimeConfig().AppendStack(spiderConfig.ID, 0)
+			if err := spider.fetchListFromPage(spiderConfig, 0, false); err != SpiderErrorSuccess {
+				t.Fatalf("expected success, got %v", err)
+			}
+			if !slices.Equal(db.inserted, c.inserted) {
+				t.Fatalf("expected %v inserted, got %v", c.inserted, db.inserted)
+			}
+		})
+	}
+}
+
+func TestSpiderPageStackResumeFromQuota(t *testing.T) {
+	db := newFakeDBService()
+	quota := &fakeQuotaService{maxPosts: 4}
+	spider, spiderConfig := newFixtureSpider(t, db, quota)
+	runtimeConfig := spider.app.GetRuntimeConfig()
+	runtimeConfig.AppendStack(spiderConfig.ID, 0)
+	if err := spider.fetchListFromPage(spiderConfig, 0, false); err != SpiderErrorQuotaExceeded {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	if expected := []string{"105", "104", "103", "102"}; !slices.Equal(db.inserted, expected) {
+		t.Fatalf("expected %v inserted, got %v", expected, db.inserted)
+	}
+	// 第 1 页已经完成, 栈顶记录为 1, 下次从第 2 页继续
+	top := runtimeConfig.StackTop(spiderConfig.ID)
+	if top == nil || *top != 1 {
+		t.Fatalf("expected stack top 1, got %v", top)
+	}
+
+	quota.maxPosts = 0
+	if err := spider.fetchListFromPage(spiderConfig, *top, true); err != SpiderErrorSuccess {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if expected := []string{"105", "104", "103", "102", "101"}; !slices.Equal(db.inserted, expected) {
+		t.Fatalf("expected %v inserted, got %v", expected, db.inserted)
+	}
+	if top := runtimeConfig.StackTop(spiderConfig.ID); top != nil {
+		t.Fatalf("expected empty stack, got top %d", *top)
+	}
+}
@@ -0,0 +1,60 @@
+package plugins
+
+import (
+	"fmt"
+	"log/slog"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models/config"
+)
+
+const StoragePluginID string = "Storage"
+
+// Storage 根据配置选择存储的实现, 所有的方法都由 backend 提供
+type Storage struct {
+	interfaces.IStorageService
+	app interfaces.IApplication
+}
+
+func newStorage() *Storage {
+	storage := Storage{}
+	return &storage
+}
+
+func init() {
+	storage := newStorage()
+	interfaces.Plugins[storage.ID()] = storage
+}
+
+func (s *Storage) Name() string {
+	return "Storage"
+}
+func (s *Storage) ID() string {
+	return StoragePluginID
+}
+func (s *Storage) Load(app interfaces.IApplication) error {
+	s.app = app
+	storageConfig := app.GetAppConfig().Storage
+	var err error
+	switch storageConfig.Type {
+	case "", config.StorageTypeLocal:
+		s.IStorageService, err = newLocalStorage(app.GetAppConfig().ImageDir)
+	case config.StorageTypeS3:
+		s.IStorageService, err = newS3Storage(&storageConfig.S3)
+	default:
+		err = fmt.Errorf("unknown storage type: %s", storageConfig.Type)
+	}
+	if err != nil {
+		slog.Error("init storage failed", "type", storageConfig.Type, "error", err)
+		return err
+	}
+	return nil
+}
+func (s *Storage) Unload() {
+}
+func (s *Storage) GetService(serviceID interfaces.ServiceID) (interfaces.IService, error) {
+	switch serviceID {
+	case interfaces.StorageServiceID:
+		return s, nil
+	}
+	return nil, fmt.Errorf("service not found")
+}
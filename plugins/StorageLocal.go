@@ -0,0 +1,172 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"ywwzwb/imagespider/models"
+)
+
+// localStorage 保存在本地目录中
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) (*localStorage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{root: root}, nil
+}
+
+// path 返回 key 对应的本地路径, key 不能指向 root 之外
+func (l *localStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "\x00") {
+		return "", fmt.Errorf("invalid key: %s", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(cleaned)), nil
+}
+func (l *localStorage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	// 先写入临时文件, 避免读取到写了一半的文件
+	tempPath := filePath + ".uploading"
+	output, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, reader); err != nil {
+		output.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, filePath)
+}
+func (l *localStorage) PutFile(key, localPath, contentType string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return moveFile(localPath, filePath)
+}
+func (l *localStorage) Get(key string) (io.ReadCloser, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, NotFound
+	}
+	return file, err
+}
+func (l *localStorage) Stat(key string) (*models.StorageObject, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &models.StorageObject{Key: key, Size: stat.Size(), LastModified: stat.ModTime()}, nil
+}
+func (l *localStorage) Delete(key string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+func (l *localStorage) List(prefix string, fn func(object models.StorageObject) error) error {
+	err := filepath.WalkDir(l.root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(models.StorageObject{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+	return err
+}
+func (l *localStorage) LocalPath(key string) (string, bool) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return "", false
+	}
+	return filePath, true
+}
+func (l *localStorage) PresignedURL(key string, expires time.Duration) (string, bool, error) {
+	return "", false, nil
+}
+
+// moveFile 移动文件, 不在同一个文件系统时复制之后删除
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	if err := copyFile(from, to); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+func copyFile(from, to string) error {
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := output.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage 保存在 S3 兼容的对象存储中
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage(config *config.S3StorageConfig) (*s3Storage, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage := &s3Storage{client: client, bucket: config.Bucket, prefix: strings.Trim(config.Prefix, "/")}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return storage, nil
+}
+func (s *s3Storage) objectName(key string) string {
+	if len(s.prefix) == 0 {
+		return strings.TrimPrefix(key, "/")
+	}
+	return path.Join(s.prefix, key)
+}
+func (s *s3Storage) key(objectName string) string {
+	if len(s.prefix) == 0 {
+		return objectName
+	}
+	return strings.TrimPrefix(objectName, s.prefix+"/")
+}
+
+// convertError 把不存在的错误转换为 NotFound
+func (s *s3Storage) convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return NotFound
+	}
+	return err
+}
+func (s *s3Storage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key), reader, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+func (s *s3Storage) PutFile(key, localPath, contentType string) error {
+	_, err := s.client.FPutObject(context.Background(), s.bucket, s.objectName(key), localPath, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.convertError(err)
+	}
+	// GetObject 不会请求服务器, 用 Stat 检查是否存在
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, s.convertError(err)
+	}
+	return object, nil
+}
+func (s *s3Storage) Stat(key string) (*models.StorageObject, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.convertError(err)
+	}
+	return &models.StorageObject{Key: key, Size: info.Size, LastModified: info.LastModified}, nil
+}
+func (s *s3Storage) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+func (s *s3Storage) List(prefix string, fn func(object models.StorageObject) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listPrefix := s.objectName(prefix)
+	if len(prefix) == 0 && len(s.prefix) != 0 {
+		listPrefix = s.prefix + "/"
+	}
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: listPrefix, Recursive: true}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(models.StorageObject{Key: s.key(info.Key), Size: info.Size, LastModified: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (s *s3Storage) LocalPath(key string) (string, bool) {
+	return "", false
+}
+func (s *s3Storage) PresignedURL(key string, expires time.Duration) (string, bool, error) {
+	url, err := s.client.PresignedGetObject(context.Background(), s.bucket, s.objectName(key), expires, nil)
+	if err != nil {
+		return "", true, err
+	}
+	return url.String(), true, nil
+}
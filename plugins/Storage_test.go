@@ -0,0 +1,217 @@
+package plugins
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+	"ywwzwb/imagespider/models/config"
+)
+
+// testStorageService 检查 IStorageService 的通用行为, 本地存储和 S3 存储共用
+func testStorageService(t *testing.T, storage interfaces.IStorageService) {
+	t.Helper()
+	content := "image content"
+	if err := storage.Put("ab/cd/ef/abcdef.heic", strings.NewReader(content), int64(len(content)), "image/heic"); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := storage.Get("ab/cd/ef/abcdef.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != content {
+		t.Fatalf("get: unexpected content %q, error: %v", data, err)
+	}
+	object, err := storage.Stat("ab/cd/ef/abcdef.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Key != "ab/cd/ef/abcdef.heic" || object.Size != int64(len(content)) || object.LastModified.IsZero() {
+		t.Fatalf("stat: unexpected object %+v", object)
+	}
+
+	localPath := filepath.Join(t.TempDir(), "upload.heic")
+	if err := os.WriteFile(localPath, []byte("uploaded file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutFile("ab/cd/ef/abcdef@320.heic", localPath, "image/heic"); err != nil {
+		t.Fatal(err)
+	}
+	if object, err := storage.Stat("ab/cd/ef/abcdef@320.heic"); err != nil || object.Size != int64(len("uploaded file")) {
+		t.Fatalf("stat after put file: %+v, error: %v", object, err)
+	}
+	if err := storage.Put("12/34/56/123456.heic", strings.NewReader(content), int64(len(content)), "image/heic"); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(prefix string) []string {
+		keys := make([]string, 0)
+		err := storage.List(prefix, func(object models.StorageObject) error {
+			keys = append(keys, object.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	if keys := list("ab/"); !slices.Equal(keys, []string{"ab/cd/ef/abcdef.heic", "ab/cd/ef/abcdef@320.heic"}) {
+		t.Fatalf("list ab/: unexpected keys %v", keys)
+	}
+	if keys := list(""); len(keys) != 3 {
+		t.Fatalf("list all: unexpected keys %v", keys)
+	}
+	// fn 返回错误时停止
+	stopErr := io.ErrUnexpectedEOF
+	count := 0
+	err = storage.List("", func(object models.StorageObject) error {
+		count++
+		return stopErr
+	})
+	if err != stopErr || count != 1 {
+		t.Fatalf("list should stop on error, count: %d, error: %v", count, err)
+	}
+
+	if err := storage.Delete("ab/cd/ef/abcdef.heic"); err != nil {
+		t.Fatal(err)
+	}
+	// 删除不存在的文件不是错误
+	if err := storage.Delete("ab/cd/ef/abcdef.heic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("ab/cd/ef/abcdef.heic"); err != NotFound {
+		t.Fatalf("stat deleted: expected NotFound, got %v", err)
+	}
+	if _, err := storage.Get("ab/cd/ef/abcdef.heic"); err != NotFound {
+		t.Fatalf("get deleted: expected NotFound, got %v", err)
+	}
+	if keys := list("ab/"); !slices.Equal(keys, []string{"ab/cd/ef/abcdef@320.heic"}) {
+		t.Fatalf("list after delete: unexpected keys %v", keys)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	storage, err := newLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageService(t, storage)
+
+	localPath, ok := storage.LocalPath("ab/cd/ef/abcdef@320.heic")
+	if !ok || localPath != filepath.Join(root, "ab", "cd", "ef", "abcdef@320.heic") {
+		t.Fatalf("unexpected local path: %s", localPath)
+	}
+	if _, ok, err := storage.PresignedURL("ab/cd/ef/abcdef@320.heic", time.Hour); ok || err != nil {
+		t.Fatalf("local storage should not support presigned url, error: %v", err)
+	}
+	// 写入时的临时文件不能留下
+	if matches, _ := filepath.Glob(filepath.Join(root, "*", "*", "*", "*.uploading")); len(matches) != 0 {
+		t.Fatalf("temp files left: %v", matches)
+	}
+}
+
+func TestLocalStoragePutFileMovesFile(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPath := filepath.Join(t.TempDir(), "converted.heic")
+	if err := os.WriteFile(localPath, []byte("converted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutFile("ab/cd/ef/abcdef.heic", localPath, "image/heic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("local file should be moved, error: %v", err)
+	}
+}
+
+func TestLocalStorageKeyStaysInRoot(t *testing.T) {
+	root := t.TempDir()
+	storage, err := newLocalStorage(filepath.Join(root, "images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put("../outside.heic", strings.NewReader("x"), 1, "image/heic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside.heic")); !os.IsNotExist(err) {
+		t.Fatal("key escaped the storage root")
+	}
+	if _, err := os.Stat(filepath.Join(root, "images", "outside.heic")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "/", "..", "a\x00b"} {
+		if err := storage.Put(key, strings.NewReader("x"), 1, "image/heic"); err == nil {
+			t.Fatalf("invalid key %q accepted", key)
+		}
+	}
+}
+
+// S3 存储需要一个 MinIO 或者其他兼容的服务, 例如:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	IMAGESPIDER_TEST_S3_ENDPOINT=127.0.0.1:9000 go test ./plugins -run S3
+//
+// 没有设置 IMAGESPIDER_TEST_S3_ENDPOINT 时跳过
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("IMAGESPIDER_TEST_S3_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("IMAGESPIDER_TEST_S3_ENDPOINT is not set")
+	}
+	env := func(name, defaultValue string) string {
+		if value := os.Getenv(name); len(value) != 0 {
+			return value
+		}
+		return defaultValue
+	}
+	s3Config := &config.S3StorageConfig{
+		Endpoint:  endpoint,
+		Region:    env("IMAGESPIDER_TEST_S3_REGION", "us-east-1"),
+		Bucket:    env("IMAGESPIDER_TEST_S3_BUCKET", "imagespider-test"),
+		AccessKey: env("IMAGESPIDER_TEST_S3_ACCESS_KEY", "minioadmin"),
+		SecretKey: env("IMAGESPIDER_TEST_S3_SECRET_KEY", "minioadmin"),
+		UseSSL:    os.Getenv("IMAGESPIDER_TEST_S3_USE_SSL") == "true",
+		// 每次测试使用不同的前缀, 互不影响
+		Prefix: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	storage, err := newS3Storage(s3Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storage.List("", func(object models.StorageObject) error {
+			return storage.Delete(object.Key)
+		})
+	})
+	testStorageService(t, storage)
+
+	if _, ok := storage.LocalPath("ab/cd/ef/abcdef@320.heic"); ok {
+		t.Fatal("s3 storage should not have local path")
+	}
+	url, ok, err := storage.PresignedURL("ab/cd/ef/abcdef@320.heic", time.Minute)
+	if !ok || err != nil {
+		t.Fatalf("presigned url failed, ok: %v, error: %v", ok, err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "uploaded file" {
+		t.Fatalf("presigned url returned %s: %q", resp.Status, data)
+	}
+}
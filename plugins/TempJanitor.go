@@ -0,0 +1,190 @@
+package plugins
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ywwzwb/imagespider/interfaces"
+	"ywwzwb/imagespider/models"
+)
+
+const TempJanitorPluginID string = "TempJanitor"
+
+// TempJanitor 定期清理下载临时目录
+// 文件名以 ImageMeta.Hash 开头, 对应的数据还在等待下载并且 source 还在配置中时保留, 其他的文件超过 MaxAge 没有修改时删除
+type TempJanitor struct {
+	app             interfaces.IApplication
+	dbService       interfaces.IDBService
+	tempPath        string
+	stopChain       chan bool
+	stopFinishChain chan bool
+	goroutinCount   atomic.Int32
+	sweepMtx        sync.Mutex
+	reportMtx       sync.Mutex
+	lastReport      *models.JanitorReport
+}
+
+func newTempJanitor() *TempJanitor {
+	janitor := TempJanitor{}
+	janitor.stopChain = make(chan bool)
+	janitor.stopFinishChain = make(chan bool)
+	return &janitor
+}
+
+func init() {
+	janitor := newTempJanitor()
+	interfaces.Plugins[janitor.ID()] = janitor
+}
+
+func (t *TempJanitor) Name() string {
+	return "TempJanitor"
+}
+func (t *TempJanitor) ID() string {
+	return TempJanitorPluginID
+}
+func (t *TempJanitor) Load(app interfaces.IApplication) error {
+	t.app = app
+	t.tempPath = path.Join(app.GetAppConfig().WorkDir, downloadTempDirName)
+	dbService, err := app.GetService(t.ID(), DBPluginID, interfaces.DBServiceID)
+	if err != nil {
+		slog.Error("get db service failed", "error", err)
+		return err
+	}
+	t.dbService = dbService.(interfaces.IDBService)
+	t.goroutinCount.Add(1)
+	go t.run()
+	return nil
+}
+func (t *TempJanitor) Unload() {
+	for ; t.goroutinCount.Load() > 0; t.goroutinCount.Add(-1) {
+		t.stopChain <- true
+		<-t.stopFinishChain
+	}
+}
+func (t *TempJanitor) GetService(serviceID interfaces.ServiceID) (interfaces.IService, error) {
+	switch serviceID {
+	case interfaces.TempJanitorServiceID:
+		return t, nil
+	}
+	return nil, fmt.Errorf("service not found")
+}
+func (t *TempJanitor) interval() time.Duration {
+	if interval := t.app.GetAppConfig().TempJanitorConfig.Interval; interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return time.Hour
+}
+func (t *TempJanitor) maxAge() time.Duration {
+	if maxAge := t.app.GetAppConfig().TempJanitorConfig.MaxAge; maxAge > 0 {
+		return time.Duration(maxAge) * time.Second
+	}
+	return 24 * time.Hour
+}
+func (t *TempJanitor) run() {
+	for {
+		t.Sweep()
+		select {
+		case <-t.stopChain:
+			t.stopFinishChain <- true
+			return
+		case <-time.After(t.interval()):
+		}
+	}
+}
+
+// tempFileMetaHash 返回临时文件对应的 ImageMeta.Hash, 预览图以及转换的中间文件(sha256 命名)没有对应的数据
+func tempFileMetaHash(name string) (string, bool) {
+	if len(name) < 32 || (len(name) > 32 && name[32] != '.') || strings.HasSuffix(name, ".preview") {
+		return "", false
+	}
+	if _, err := hex.DecodeString(name[:32]); err != nil {
+		return "", false
+	}
+	return name[:32], true
+}
+func (t *TempJanitor) Sweep() models.JanitorReport {
+	t.sweepMtx.Lock()
+	defer t.sweepMtx.Unlock()
+	report := t.sweep()
+	logger := slog.With("scanned", report.ScannedFiles, "kept", report.KeptFiles, "deleted", report.DeletedFiles, "reclaimedBytes", report.ReclaimedBytes)
+	if len(report.Error) != 0 {
+		logger.Error("sweep download temp dir failed", "error", report.Error)
+	} else {
+		logger.Info("sweep download temp dir finish")
+	}
+	t.reportMtx.Lock()
+	t.lastReport = &report
+	t.reportMtx.Unlock()
+	return report
+}
+func (t *TempJanitor) sweep() models.JanitorReport {
+	report := models.JanitorReport{StartTime: time.Now()}
+	entries, err := os.ReadDir(t.tempPath)
+	if os.IsNotExist(err) {
+		return report
+	}
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	hashes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		if hash, ok := tempFileMetaHash(info.Name()); ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	report.ScannedFiles = len(files)
+	pending, err := t.dbService.FilterPendingDownloadHashes(hashes)
+	if err != nil {
+		// 无法确定文件是否还有用, 这次不删除
+		report.Error = err.Error()
+		report.KeptFiles = len(files)
+		return report
+	}
+	spiders := t.app.GetAppConfig().Spiders
+	deadline := report.StartTime.Add(-t.maxAge())
+	for _, info := range files {
+		if hash, ok := tempFileMetaHash(info.Name()); ok {
+			if sourceID, ok := pending[hash]; ok {
+				if _, ok := spiders[sourceID]; ok {
+					report.KeptFiles++
+					continue
+				}
+			}
+		}
+		if info.ModTime().After(deadline) {
+			// 可能正在使用
+			report.KeptFiles++
+			continue
+		}
+		if err := os.Remove(path.Join(t.tempPath, info.Name())); err != nil {
+			slog.Warn("remove temp file failed", "file", info.Name(), "error", err)
+			report.KeptFiles++
+			continue
+		}
+		slog.Debug("remove orphan temp file", "file", info.Name(), "size", info.Size())
+		report.DeletedFiles++
+		report.ReclaimedBytes += info.Size()
+	}
+	return report
+}
+func (t *TempJanitor) LastReport() *models.JanitorReport {
+	t.reportMtx.Lock()
+	defer t.reportMtx.Unlock()
+	return t.lastReport
+}
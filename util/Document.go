@@ -0,0 +1,188 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+// 页面没有声明编码, 又不是合法的 UTF-8 时, 依次尝试的编码
+// ranges 是该编码的文字应该落在的 unicode 范围, script 是该语言特有的文字(例如日文的假名), 解码结果中必须占一定比例
+var sniffCharsets = []struct {
+	name   string
+	ranges *unicode.RangeTable
+	script *unicode.RangeTable
+}{
+	{"shift_jis", japaneseRanges, kanaRanges},
+	{"euc-jp", japaneseRanges, kanaRanges},
+	{"euc-kr", koreanRanges, unicode.Hangul},
+	{"gb18030", chineseRanges, nil},
+	{"big5", chineseRanges, nil},
+}
+var (
+	japaneseRanges = &unicode.RangeTable{R16: []unicode.Range16{
+		{Lo: 0x3000, Hi: 0x303f, Stride: 1}, // CJK 标点
+		{Lo: 0x3040, Hi: 0x30ff, Stride: 1}, // 平假名, 片假名
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1}, // 汉字
+		{Lo: 0xff01, Hi: 0xff5e, Stride: 1}, // 全角字符
+	}}
+	kanaRanges = &unicode.RangeTable{R16: []unicode.Range16{
+		{Lo: 0x3040, Hi: 0x30ff, Stride: 1},
+	}}
+	chineseRanges = &unicode.RangeTable{R16: []unicode.Range16{
+		{Lo: 0x3000, Hi: 0x303f, Stride: 1},
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1},
+		{Lo: 0xff01, Hi: 0xff5e, Stride: 1},
+	}}
+	koreanRanges = &unicode.RangeTable{R16: []unicode.Range16{
+		{Lo: 0x3000, Hi: 0x303f, Stride: 1},
+		{Lo: 0x3130, Hi: 0x318f, Stride: 1}, // 韩文字母
+		{Lo: 0xac00, Hi: 0xd7af, Stride: 1}, // 韩文音节
+		{Lo: 0xff01, Hi: 0xff5e, Stride: 1},
+	}}
+)
+
+const sniffMinScriptRatio = 0.1
+
+// NewDocumentFromResponse 解析响应体, 并记录最终的页面地址(跟随重定向之后), 用于解析相对地址
+// 页面编码按 charsetOverride, Content-Type, BOM, <meta charset>, 内容探测 的顺序确定, 并在解析前转换为 UTF-8
+func NewDocumentFromResponse(resp *http.Response, charsetOverride string) (*goquery.Document, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	enc, name, err := detectCharset(body, resp.Header.Get("Content-Type"), charsetOverride)
+	if err != nil {
+		return nil, err
+	}
+	if enc != encoding.Nop {
+		slog.Debug("transcode page", "charset", name)
+		if body, err = enc.NewDecoder().Bytes(body); err != nil {
+			return nil, fmt.Errorf("transcode page from %s failed: %w", name, err)
+		}
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Request != nil {
+		doc.Url = resp.Request.URL
+	}
+	return doc, nil
+}
+
+func detectCharset(body []byte, contentType, charsetOverride string) (encoding.Encoding, string, error) {
+	if len(charsetOverride) > 0 {
+		enc, name := charset.Lookup(charsetOverride)
+		if enc == nil {
+			return nil, "", fmt.Errorf("unknown charset: %s", charsetOverride)
+		}
+		return normalizeEncoding(enc, name), name, nil
+	}
+	enc, name, certain := charset.DetermineEncoding(body, contentType)
+	if certain && name == "utf-8" && !utf8.Valid(body) {
+		// 服务端声明了 UTF-8, 但内容并不是, 忽略 Content-Type 重新检测
+		enc, name, certain = charset.DetermineEncoding(body, "")
+	}
+	if certain {
+		return normalizeEncoding(enc, name), name, nil
+	}
+	if name != "windows-1252" && name != "utf-8" {
+		// 来自 <meta charset>
+		return normalizeEncoding(enc, name), name, nil
+	}
+	// DetermineEncoding 只检查前 1024 字节, 这里检查整个页面
+	if utf8.Valid(body) {
+		return encoding.Nop, "utf-8", nil
+	}
+	// 按解码后的非 ASCII 字符落在对应文字范围内的比例打分, 取最高的
+	bestScore := 0.0
+	for _, candidate := range sniffCharsets {
+		candidateEnc, candidateName := charset.Lookup(candidate.name)
+		if candidateEnc == nil {
+			continue
+		}
+		decoded, err := candidateEnc.NewDecoder().Bytes(body)
+		if err != nil || bytes.ContainsRune(decoded, utf8.RuneError) {
+			continue
+		}
+		total, matched, script := 0, 0, 0
+		for _, r := range string(decoded) {
+			if r < utf8.RuneSelf {
+				continue
+			}
+			total++
+			if unicode.Is(candidate.ranges, r) {
+				matched++
+			}
+			if candidate.script != nil && unicode.Is(candidate.script, r) {
+				script++
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		if candidate.script != nil && float64(script)/float64(total) < sniffMinScriptRatio {
+			continue
+		}
+		if score := float64(matched) / float64(total); score > bestScore {
+			bestScore = score
+			enc, name = candidateEnc, candidateName
+		}
+	}
+	return enc, name, nil
+}
+
+func normalizeEncoding(enc encoding.Encoding, name string) encoding.Encoding {
+	if name == "utf-8" {
+		return encoding.Nop
+	}
+	return enc
+}
+
+// BaseURL 返回页面中相对地址的基准地址, 优先使用 <base href>, 否则使用页面地址
+func BaseURL(doc *goquery.Document) *url.URL {
+	if doc == nil {
+		return nil
+	}
+	base := doc.Url
+	href, ok := doc.Find("base[href]").First().Attr("href")
+	if !ok {
+		return base
+	}
+	baseHref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return base
+	}
+	if base == nil {
+		if baseHref.IsAbs() {
+			return baseHref
+		}
+		return nil
+	}
+	return base.ResolveReference(baseHref)
+}
+
+// ResolveURL 以页面的基准地址, 把相对地址(包括 //host/path 形式)转换为绝对地址
+func ResolveURL(doc *goquery.Document, value string) string {
+	value = strings.TrimSpace(value)
+	base := BaseURL(doc)
+	if base == nil {
+		return value
+	}
+	ref, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -2,10 +2,12 @@ package util
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"ywwzwb/imagespider/models/config"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/antchfx/htmlquery"
 )
 
 type HTMLParser struct {
@@ -19,24 +21,81 @@ func NewParser(config *config.HTMLParserConfig) *HTMLParser {
 }
 func (p *HTMLParser) Parse(doc *goquery.Document) ([]string, error) {
 	result := make([]string, 0)
-	elements := doc.Find(p.config.Selector)
-	if elements == nil {
-		return result, fmt.Errorf("no elements found, selector: %s", p.config.Selector)
+	elements, err := p.find(doc)
+	if err != nil {
+		return result, err
 	}
-	elements.Each(func(i int, s *goquery.Selection) {
+	for _, s := range elements {
 		if !p.match(s, p.config.ElementMatherConfig) {
-			return
+			continue
 		}
-		if value, ok := p.getValue(s, &p.config.Value); ok {
-			result = append(result, value)
+		if values, ok := p.getValue(doc, s, &p.config.Value); ok {
+			result = append(result, values...)
 		}
-	})
+	}
+	return result, nil
+}
+
+// ParseURL 解析地址类的值, 相对地址会以页面的基准地址转换为绝对地址
+func (p *HTMLParser) ParseURL(doc *goquery.Document) ([]string, error) {
+	result, err := p.Parse(doc)
+	for idx, value := range result {
+		result[idx] = ResolveURL(doc, value)
+	}
+	return result, err
+}
+
+// find 根据 selector 类型查找元素, css 和 xpath 查找的结果都转换为 goquery.Selection, 以便后续的匹配和取值逻辑保持一致
+func (p *HTMLParser) find(doc *goquery.Document) ([]*goquery.Selection, error) {
+	result := make([]*goquery.Selection, 0)
+	switch p.config.SelectorType {
+	case config.SelectorTypeXPath:
+		if p.config.XPath == nil {
+			return result, fmt.Errorf("xpath not compiled, selector: %s", p.config.Selector)
+		}
+		for _, root := range doc.Nodes {
+			for _, node := range htmlquery.QuerySelectorAll(root, p.config.XPath) {
+				s := doc.FindNodes(node)
+				if s.Length() == 0 {
+					// 属性节点等不在文档树中的节点, 单独包装
+					s = goquery.NewDocumentFromNode(node).Selection
+				}
+				result = append(result, s)
+			}
+		}
+	default:
+		elements := doc.Find(p.config.Selector)
+		if elements == nil {
+			return result, fmt.Errorf("no elements found, selector: %s", p.config.Selector)
+		}
+		elements.Each(func(i int, s *goquery.Selection) {
+			result = append(result, s)
+		})
+	}
 	return result, nil
 }
 func (p *HTMLParser) match(selection *goquery.Selection, m *config.ElementMatherConfig) bool {
 	if m == nil {
 		return true
 	}
+	switch {
+	case len(m.All) > 0:
+		for _, sub := range m.All {
+			if !p.match(selection, sub) {
+				return false
+			}
+		}
+		return true
+	case len(m.Any) > 0:
+		for _, sub := range m.Any {
+			if p.match(selection, sub) {
+				return true
+			}
+		}
+		return false
+	case m.Not != nil:
+		return !p.match(selection, m.Not)
+	}
 	val, ok := p.getAttribute(selection, m.Attribute)
 	if !ok {
 		return false
@@ -44,6 +103,33 @@ func (p *HTMLParser) match(selection *goquery.Selection, m *config.ElementMather
 	switch m.OperatorType {
 	case config.OperatorContain:
 		return strings.Contains(val, m.Value)
+	case config.OperatorEquals:
+		return val == m.Value
+	case config.OperatorPrefix:
+		return strings.HasPrefix(val, m.Value)
+	case config.OperatorSuffix:
+		return strings.HasSuffix(val, m.Value)
+	case config.OperatorRegex:
+		return m.Regex != nil && m.Regex.MatchString(val)
+	case config.OperatorHasAttribute:
+		return true
+	}
+	if !m.OperatorType.IsNumeric() {
+		return false
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return false
+	}
+	switch m.OperatorType {
+	case config.OperatorGreaterThan:
+		return number > m.Number
+	case config.OperatorGreaterEqual:
+		return number >= m.Number
+	case config.OperatorLessThan:
+		return number < m.Number
+	case config.OperatorLessEqual:
+		return number <= m.Number
 	default:
 		return false
 	}
@@ -52,22 +138,21 @@ func (p *HTMLParser) getAttribute(s *goquery.Selection, attr config.AttributeTyp
 	switch attr {
 	case config.AttributeTypeInnerText:
 		return s.Text(), true
-	case config.AttributeTypeHref:
-		return s.Attr("href")
-	case config.AttributeTypeTitle:
-		return s.Attr("title")
 	default:
-		break
+		return s.Attr(string(attr))
 	}
-	return "", false
 }
-func (p *HTMLParser) getValue(s *goquery.Selection, valueConfig *config.ValueConfig) (string, bool) {
+func (p *HTMLParser) getValue(doc *goquery.Document, s *goquery.Selection, valueConfig *config.ValueConfig) ([]string, bool) {
 	value, ok := p.getAttribute(s, valueConfig.Attribute)
 	if !ok {
-		return "", false
+		return nil, false
+	}
+	if valueConfig.ReplacerConfig != nil {
+		value = valueConfig.ReplacerConfig.Regex.ReplaceAllString(value, valueConfig.ReplacerConfig.Replacement)
 	}
-	if valueConfig.ReplacerConfig == nil {
-		return value, true
+	if len(valueConfig.Transforms) == 0 {
+		return []string{value}, true
 	}
-	return valueConfig.ReplacerConfig.Regex.ReplaceAllString(value, valueConfig.ReplacerConfig.Replacement), true
+	values := transformValue(doc, value, valueConfig.Transforms)
+	return values, len(values) > 0
 }
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewHTTPClient 创建抓取用的 http client, connectTimeout 单位为秒
+// 如果启用了录制/回放, 请求会经过 HTTPFixture
+func NewHTTPClient(connectTimeout int) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		// 设置连接超时时间
+		DialContext: (&net.Dialer{
+			Timeout: time.Duration(connectTimeout) * time.Second,
+		}).DialContext,
+	}
+	if httpFixture != nil {
+		transport = httpFixture.Transport(transport)
+	}
+	return &http.Client{
+		Transport: transport,
+	}
+}
@@ -0,0 +1,281 @@
+package util
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"ywwzwb/imagespider/models/config"
+)
+
+const (
+	HTTPFixtureModeRecord = "record"
+	HTTPFixtureModeReplay = "replay"
+)
+
+// 回放时, 原始请求的地址放在这个 header 中发给本地的替身服务
+const httpFixtureURLHeader = "X-Http-Fixture-Url"
+
+// httpFixtureEntry 一条录制的请求/响应, 保存为 <key>.json, 响应体保存为 <key>.body
+type httpFixtureEntry struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Range  string      `json:"range,omitempty"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+}
+
+// HTTPFixture 录制/回放 http 请求
+// record 模式下, 所有经过 Transport 的请求和响应都会保存到 dir 中
+// replay 模式下, 会启动一个本地的替身服务, 从 dir 中读取录制的响应, 所有经过 Transport 的请求都会转发到替身服务
+type HTTPFixture struct {
+	mode     string
+	dir      string
+	writeMtx sync.Mutex
+	listener net.Listener
+	server   *http.Server
+}
+
+var httpFixture *HTTPFixture
+
+// InitHTTPFixture 根据配置初始化全局的录制/回放, 之后通过 NewHTTPClient 创建的 client 都会使用它
+func InitHTTPFixture(fixtureConfig config.HTTPFixtureConfig) error {
+	if len(fixtureConfig.Mode) == 0 {
+		return nil
+	}
+	fixture, err := NewHTTPFixture(fixtureConfig.Mode, fixtureConfig.Dir)
+	if err != nil {
+		return err
+	}
+	httpFixture = fixture
+	slog.Info("http fixture is initialized", "config", fixtureConfig)
+	return nil
+}
+
+// CloseHTTPFixture 关闭全局的录制/回放
+func CloseHTTPFixture() {
+	if httpFixture == nil {
+		return
+	}
+	httpFixture.Close()
+	httpFixture = nil
+}
+
+func NewHTTPFixture(mode, dir string) (*HTTPFixture, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("http fixture dir is empty")
+	}
+	fixture := &HTTPFixture{mode: mode, dir: dir}
+	switch mode {
+	case HTTPFixtureModeRecord:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	case HTTPFixtureModeReplay:
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		fixture.listener = listener
+		fixture.server = &http.Server{Handler: http.HandlerFunc(fixture.serveReplay)}
+		go func() {
+			if err := fixture.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				slog.Error("http fixture server failed", "error", err)
+			}
+		}()
+		slog.Info("http fixture replay server started", "addr", listener.Addr().String(), "dir", dir)
+	default:
+		return nil, fmt.Errorf("invalid http fixture mode: %s", mode)
+	}
+	return fixture, nil
+}
+
+// URL 回放模式下本地替身服务的地址
+func (f *HTTPFixture) URL() string {
+	if f.listener == nil {
+		return ""
+	}
+	return "http://" + f.listener.Addr().String()
+}
+func (f *HTTPFixture) Close() {
+	if f.server != nil {
+		f.server.Close()
+	}
+}
+
+// Transport 包装 base, 按模式录制或回放经过的请求
+func (f *HTTPFixture) Transport(base http.RoundTripper) http.RoundTripper {
+	return &httpFixtureTransport{fixture: f, base: base}
+}
+
+type httpFixtureTransport struct {
+	fixture *HTTPFixture
+	base    http.RoundTripper
+}
+
+func (t *httpFixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.fixture.mode == HTTPFixtureModeReplay {
+		return t.replay(req)
+	}
+	return t.record(req)
+}
+func (t *httpFixtureTransport) record(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	entry := httpFixtureEntry{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Range:  req.Header.Get("Range"),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+	}
+	body, err := t.fixture.create(&entry)
+	if err != nil {
+		slog.Error("save http fixture failed", "url", entry.URL, "error", err)
+		return resp, nil
+	}
+	// 调用方读取响应的同时写入文件, 读完之后才保存, 没有读完的响应不保存
+	resp.Body = &httpFixtureRecorder{ReadCloser: resp.Body, fixture: t.fixture, entry: &entry, body: body}
+	return resp, nil
+}
+
+// httpFixtureRecorder 把读取到的响应体写入临时文件, 读到结尾之后关闭时保存为 fixture
+type httpFixtureRecorder struct {
+	io.ReadCloser
+	fixture  *HTTPFixture
+	entry    *httpFixtureEntry
+	body     *os.File
+	err      error
+	complete bool
+}
+
+func (r *httpFixtureRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.err == nil {
+		_, r.err = r.body.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+func (r *httpFixtureRecorder) Close() error {
+	err := r.ReadCloser.Close()
+	if r.body == nil {
+		return err
+	}
+	if closeErr := r.body.Close(); r.err == nil {
+		r.err = closeErr
+	}
+	if r.err == nil && !r.complete {
+		r.err = errors.New("response body is not fully read")
+	}
+	if r.err == nil {
+		r.err = r.fixture.commit(r.entry, r.body.Name())
+	}
+	if r.err != nil {
+		slog.Error("save http fixture failed", "url", r.entry.URL, "error", r.err)
+		os.Remove(r.body.Name())
+	}
+	r.body = nil
+	return err
+}
+func (t *httpFixtureTransport) replay(req *http.Request) (*http.Response, error) {
+	replayReq := req.Clone(req.Context())
+	replayReq.Header.Set(httpFixtureURLHeader, req.URL.String())
+	replayReq.URL.Scheme = "http"
+	replayReq.URL.Host = t.fixture.listener.Addr().String()
+	replayReq.Host = ""
+	resp, err := t.base.RoundTrip(replayReq)
+	if err != nil {
+		return nil, err
+	}
+	// 对调用方保持原始的请求, 重定向和相对地址都基于原始地址
+	resp.Request = req
+	return resp, nil
+}
+
+func (f *HTTPFixture) key(method, url, rangeHeader string) string {
+	sum := sha1.Sum([]byte(method + " " + url + " " + rangeHeader))
+	return hex.EncodeToString(sum[:])
+}
+
+// create 创建保存响应体的临时文件, 和 fixture 在同一个目录中, 保存时直接重命名
+func (f *HTTPFixture) create(entry *httpFixtureEntry) (*os.File, error) {
+	return os.CreateTemp(f.dir, f.key(entry.Method, entry.URL, entry.Range)+".body.*.tmp")
+}
+
+// commit 把临时文件保存为响应体, 同时写入请求和响应的信息
+func (f *HTTPFixture) commit(entry *httpFixtureEntry, bodyPath string) error {
+	key := f.key(entry.Method, entry.URL, entry.Range)
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	f.writeMtx.Lock()
+	defer f.writeMtx.Unlock()
+	// CreateTemp 创建的文件只有所有者可以读取
+	if err := os.Chmod(bodyPath, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(bodyPath, filepath.Join(f.dir, key+".body")); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(f.dir, key+".json"), meta, 0644)
+}
+func (f *HTTPFixture) load(method, url, rangeHeader string) (*httpFixtureEntry, []byte, error) {
+	key := f.key(method, url, rangeHeader)
+	meta, err := os.ReadFile(filepath.Join(f.dir, key+".json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &httpFixtureEntry{}
+	if err := json.Unmarshal(meta, entry); err != nil {
+		return nil, nil, err
+	}
+	body, err := os.ReadFile(filepath.Join(f.dir, key+".body"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, body, nil
+}
+func (f *HTTPFixture) serveReplay(w http.ResponseWriter, r *http.Request) {
+	url := r.Header.Get(httpFixtureURLHeader)
+	logger := slog.With("method", r.Method, "url", url, "range", r.Header.Get("Range"))
+	entry, body, err := f.load(r.Method, url, r.Header.Get("Range"))
+	if errors.Is(err, fs.ErrNotExist) && len(r.Header.Get("Range")) > 0 {
+		// 没有录制续传的请求, 不能用完整的响应代替, 否则会掩盖续传的问题
+		logger.Error("http fixture of range request not found")
+		http.Error(w, "http fixture of range request not found: "+url, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		logger.Error("http fixture not found", "error", err)
+		http.Error(w, "http fixture not found: "+url, http.StatusNotFound)
+		return
+	}
+	logger.Debug("replay http fixture", "status", entry.Status)
+	for k, values := range entry.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(entry.Status)
+	w.Write(body)
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recordFixture(t *testing.T, dir string, handler http.HandlerFunc, fn func(client *http.Client, server *httptest.Server)) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	fixture, err := NewHTTPFixture(HTTPFixtureModeRecord, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(&http.Client{Transport: fixture.Transport(http.DefaultTransport)}, server)
+}
+
+func fixtureFiles(t *testing.T, dir, pattern string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestHTTPFixtureRecordStreamsBody(t *testing.T) {
+	dir := t.TempDir()
+	body := strings.Repeat("0123456789", 10*1024)
+	recordFixture(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}, func(client *http.Client, server *httptest.Server) {
+		resp, err := client.Get(server.URL + "/full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 读完之前不应该保存
+		if _, err := io.ReadFull(resp.Body, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if files := fixtureFiles(t, dir, "*.json"); len(files) != 0 {
+			t.Fatalf("fixture saved before body is read: %v", files)
+		}
+		rest, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if len(rest)+10 != len(body) {
+			t.Fatalf("unexpected body size: %d", len(rest)+10)
+		}
+
+		// 没有读完的响应不保存
+		resp, err = client.Get(server.URL + "/partial")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadFull(resp.Body, make([]byte, 10))
+		resp.Body.Close()
+	})
+	if files := fixtureFiles(t, dir, "*.json"); len(files) != 1 {
+		t.Fatalf("expected 1 fixture, got %v", files)
+	}
+	if files := fixtureFiles(t, dir, "*.tmp"); len(files) != 0 {
+		t.Fatalf("temp files left: %v", files)
+	}
+	bodies := fixtureFiles(t, dir, "*.body")
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 body, got %v", bodies)
+	}
+	saved, err := os.ReadFile(bodies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != body {
+		t.Fatalf("saved body mismatch, size: %d", len(saved))
+	}
+}
+
+func TestHTTPFixtureReplay(t *testing.T) {
+	dir := t.TempDir()
+	var url string
+	recordFixture(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}, func(client *http.Client, server *httptest.Server) {
+		url = server.URL + "/file.txt"
+		for _, rangeHeader := range []string{"", "bytes=4-"} {
+			req, _ := http.NewRequest("GET", url, nil)
+			if len(rangeHeader) != 0 {
+				req.Header.Set("Range", rangeHeader)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	})
+
+	fixture, err := NewHTTPFixture(HTTPFixtureModeReplay, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixture.Close()
+	client := &http.Client{Transport: fixture.Transport(http.DefaultTransport)}
+	cases := []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, "0123456789"},
+		{"bytes=4-", http.StatusPartialContent, "456789"},
+		// 没有录制的续传请求不能返回完整的内容
+		{"bytes=8-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", url, nil)
+		if len(c.rangeHeader) != 0 {
+			req.Header.Set("Range", c.rangeHeader)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("range %q: expected status %d, got %d", c.rangeHeader, c.status, resp.StatusCode)
+		}
+		if resp.Request.URL.String() != url {
+			t.Fatalf("range %q: request url is not the original url: %s", c.rangeHeader, resp.Request.URL)
+		}
+		if len(c.body) != 0 && string(body) != c.body {
+			t.Fatalf("range %q: expected body %q, got %q", c.rangeHeader, c.body, body)
+		}
+	}
+	resp, err := client.Get(url + "?missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing fixture, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,327 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// ImageInfo 下载的图片文件的信息
+type ImageInfo struct {
+	MediaType string // 通过文件头识别的类型, 例如 image/jpeg
+	Animated  bool   // 多帧的 gif / apng / webp
+	Width     int    // 无法解析的格式(例如 heic)为 0
+	Height    int
+	Size      int64
+	SHA256    string
+}
+
+// SniffMediaType 根据文件头识别类型, 在 http.DetectContentType 的基础上增加了 heic / avif / mp4 的各种 brand
+func SniffMediaType(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+			return "image/heic"
+		case "avif", "avis":
+			return "image/avif"
+		case "isom", "iso2", "mp41", "mp42", "avc1", "dash", "M4V ":
+			return "video/mp4"
+		}
+		// 其他 brand(例如 qt / 3gp) 交给 http.DetectContentType, 不当作 mp4
+	}
+	mediaType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return mediaType
+}
+
+// ExtensionForMediaType 返回 SniffMediaType 识别出的类型对应的扩展名
+func ExtensionForMediaType(mediaType string) string {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/bmp":
+		return ".bmp"
+	case "image/heic":
+		return ".heic"
+	case "image/avif":
+		return ".avif"
+	case "video/mp4":
+		return ".mp4"
+	case "video/webm":
+		return ".webm"
+	default:
+		return ".bin"
+	}
+}
+
+// MediaTypeForExtension 是 ExtensionForMediaType 的反向转换, 用于保存转换之后的文件
+func MediaTypeForExtension(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".bmp":
+		return "image/bmp"
+	case ".heic":
+		return "image/heic"
+	case ".avif":
+		return "image/avif"
+	case ".mp4":
+		return "video/mp4"
+	case ".webm":
+		return "video/webm"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// IsVideoMediaType 是否是支持的视频类型
+func IsVideoMediaType(mediaType string) bool {
+	return mediaType == "video/mp4" || mediaType == "video/webm"
+}
+
+// IsImageContentType 检查响应的 Content-Type 是否可能是图片或视频, 为空或者是二进制流时不能确定, 也认为是图片
+func IsImageContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(contentType)), ";")
+	switch {
+	case len(mediaType) == 0, strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"):
+		return true
+	case mediaType == "application/octet-stream", mediaType == "binary/octet-stream":
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidateImageFile 检查文件是否是完整的图片或视频: 文件头是图片, 结尾完整(jpeg/png/gif), 能够解析出尺寸
+// 视频只检查文件头
+func ValidateImageFile(path string) (*ImageInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := &ImageInfo{Size: stat.Size()}
+	if info.Size == 0 {
+		return info, fmt.Errorf("empty file")
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return info, err
+	}
+	head = head[:n]
+	info.MediaType = SniffMediaType(head)
+	if !strings.HasPrefix(info.MediaType, "image/") && !IsVideoMediaType(info.MediaType) {
+		return info, fmt.Errorf("not an image, detected type: %s", info.MediaType)
+	}
+	if err := checkImageTrailer(file, info); err != nil {
+		return info, err
+	}
+	if info.Animated, err = isAnimated(file, info.MediaType); err != nil {
+		return info, err
+	}
+	switch info.MediaType {
+	case "image/heic", "image/avif", "video/mp4", "video/webm":
+		// 没有可用的解码器, 只检查文件头
+	default:
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return info, err
+		}
+		config, _, err := image.DecodeConfig(file)
+		if err != nil {
+			return info, fmt.Errorf("decode image header failed: %w", err)
+		}
+		if config.Width <= 0 || config.Height <= 0 {
+			return info, fmt.Errorf("invalid image size: %dx%d", config.Width, config.Height)
+		}
+		info.Width = config.Width
+		info.Height = config.Height
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return info, err
+	}
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
+
+// checkImageTrailer 检查文件结尾, 用于发现被截断的文件
+func checkImageTrailer(file *os.File, info *ImageInfo) error {
+	var trailer []byte
+	switch info.MediaType {
+	case "image/jpeg":
+		trailer = []byte{0xff, 0xd9}
+	case "image/png":
+		trailer = []byte{0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82}
+	case "image/gif":
+		// 0x3b 可能出现在图像数据中, 需要按块读到结束标记
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, complete := walkGIF(bufio.NewReader(file), -1); !complete {
+			return fmt.Errorf("image is truncated, %s end marker not found", info.MediaType)
+		}
+		return nil
+	default:
+		return nil
+	}
+	// 部分图片在结束标记之后还有填充数据, 在最后一段内查找结束标记
+	tailSize := min(info.Size, 1024)
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, info.Size-tailSize); err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Contains(tail, trailer) {
+		return fmt.Errorf("image is truncated, %s end marker not found", info.MediaType)
+	}
+	return nil
+}
+
+// isAnimated 检查 gif / png / webp 是否有多帧
+func isAnimated(file *os.File, mediaType string) (bool, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	switch mediaType {
+	case "image/gif":
+		return gifFrameCount(bufio.NewReader(file)) > 1, nil
+	case "image/png":
+		return pngHasChunk(bufio.NewReader(file), "acTL", "IDAT"), nil
+	case "image/webp":
+		// RIFF....WEBPVP8X, VP8X 的 flags 中 0x02 表示动图
+		header := make([]byte, 21)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return false, nil
+		}
+		return string(header[12:16]) == "VP8X" && header[20]&0x02 != 0, nil
+	default:
+		return false, nil
+	}
+}
+
+// gifFrameCount 统计 gif 中的帧数, 超过 1 之后不再继续
+func gifFrameCount(r *bufio.Reader) int {
+	frames, _ := walkGIF(r, 1)
+	return frames
+}
+
+// walkGIF 按块读取 gif, 返回帧数以及是否读到了结束标记, 帧数超过 maxFrames(小于 0 时不限制) 之后不再继续
+func walkGIF(r *bufio.Reader, maxFrames int) (frames int, complete bool) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, false
+	}
+	// 全局颜色表
+	if header[10]&0x80 != 0 {
+		if _, err := r.Discard(3 << (int(header[10]&0x07) + 1)); err != nil {
+			return 0, false
+		}
+	}
+	for maxFrames < 0 || frames <= maxFrames {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return frames, false
+		}
+		switch introducer {
+		case 0x21: // 扩展
+			if _, err := r.ReadByte(); err != nil {
+				return frames, false
+			}
+			if !skipGIFSubBlocks(r) {
+				return frames, false
+			}
+		case 0x2c: // 图像
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return frames, false
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := r.Discard(3 << (int(descriptor[8]&0x07) + 1)); err != nil {
+					return frames, false
+				}
+			}
+			// LZW 最小码长
+			if _, err := r.ReadByte(); err != nil {
+				return frames, false
+			}
+			if !skipGIFSubBlocks(r) {
+				return frames, false
+			}
+			frames++
+		case 0x3b: // 结束
+			return frames, true
+		default: // 数据损坏
+			return frames, false
+		}
+	}
+	return frames, false
+}
+func skipGIFSubBlocks(r *bufio.Reader) bool {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if size == 0 {
+			return true
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return false
+		}
+	}
+}
+
+// pngHasChunk 在遇到 before 之前是否有 name chunk
+func pngHasChunk(r *bufio.Reader, name, before string) bool {
+	if _, err := r.Discard(8); err != nil {
+		return false
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return false
+		}
+		switch string(header[4:8]) {
+		case name:
+			return true
+		case before, "IEND":
+			return false
+		}
+		// 数据和 crc
+		if _, err := r.Discard(int(binary.BigEndian.Uint32(header[0:4])) + 4); err != nil {
+			return false
+		}
+	}
+}
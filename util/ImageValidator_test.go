@@ -0,0 +1,238 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func ftypHeader(brand string) []byte {
+	head := []byte{0, 0, 0, 0x18, 'f', 't', 'y', 'p'}
+	head = append(head, brand...)
+	head = append(head, 0, 0, 0, 0)
+	return append(head, brand...)
+}
+
+func TestSniffMediaTypeFtyp(t *testing.T) {
+	cases := map[string]string{
+		"heic": "image/heic",
+		"mif1": "image/heic",
+		"avif": "image/avif",
+		"isom": "video/mp4",
+		"iso2": "video/mp4",
+		"mp41": "video/mp4",
+		"mp42": "video/mp4",
+		"avc1": "video/mp4",
+		"dash": "video/mp4",
+		"M4V ": "video/mp4",
+		// 不认识的 brand 不能当作 mp4
+		"qt  ": "application/octet-stream",
+		"3gp4": "application/octet-stream",
+		"crx ": "application/octet-stream",
+	}
+	for brand, expected := range cases {
+		if mediaType := SniffMediaType(ftypHeader(brand)); mediaType != expected {
+			t.Errorf("brand %q: expected %s, got %s", brand, expected, mediaType)
+		}
+	}
+}
+
+func encodeTestImage(t *testing.T, format string) []byte {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, 8, 6), color.Palette{color.Black, color.White})
+	img.SetColorIndex(3, 2, 1)
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "animated gif":
+		err = gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// apng 在 IHDR 之后插入 acTL chunk
+func apng(t *testing.T) []byte {
+	t.Helper()
+	data := encodeTestImage(t, "png")
+	chunk := binary.BigEndian.AppendUint32(nil, 8)
+	chunk = append(chunk, "acTL"...)
+	chunk = binary.BigEndian.AppendUint32(chunk, 1)
+	chunk = binary.BigEndian.AppendUint32(chunk, 0)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	// 8 字节的签名, 25 字节的 IHDR
+	return append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateImageFile(t *testing.T) {
+	jpegData := encodeTestImage(t, "jpeg")
+	pngData := encodeTestImage(t, "png")
+	gifData := encodeTestImage(t, "gif")
+	cases := []struct {
+		name      string
+		data      []byte
+		mediaType string
+		animated  bool
+		err       string
+	}{
+		{name: "jpeg", data: jpegData, mediaType: "image/jpeg"},
+		// 结束标记之后的填充数据
+		{name: "jpeg with padding", data: append(append([]byte{}, jpegData...), make([]byte, 100)...), mediaType: "image/jpeg"},
+		{name: "truncated jpeg", data: jpegData[:len(jpegData)-10], mediaType: "image/jpeg", err: "truncated"},
+		{name: "png", data: pngData, mediaType: "image/png"},
+		{name: "truncated png", data: pngData[:len(pngData)-4], mediaType: "image/png", err: "truncated"},
+		{name: "apng", data: apng(t), mediaType: "image/png", animated: true},
+		{name: "gif", data: gifData, mediaType: "image/gif"},
+		{name: "animated gif", data: encodeTestImage(t, "animated gif"), mediaType: "image/gif", animated: true},
+		{name: "truncated gif", data: gifData[:len(gifData)-1], mediaType: "image/gif", err: "truncated"},
+		{name: "gif truncated in image data", data: gifData[:len(gifData)-4], mediaType: "image/gif", err: "truncated"},
+		{name: "not an image", data: []byte("<html></html>"), err: "not an image"},
+		{name: "empty", data: []byte{}, err: "empty file"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info, err := ValidateImageFile(writeTestFile(t, c.data))
+			if len(c.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.MediaType != c.mediaType || info.Animated != c.animated {
+				t.Fatalf("unexpected info: %s, animated: %v", info.MediaType, info.Animated)
+			}
+			if info.Width != 8 || info.Height != 6 || info.Size != int64(len(c.data)) {
+				t.Fatalf("unexpected size: %dx%d, %d bytes", info.Width, info.Height, info.Size)
+			}
+		})
+	}
+}
+
+// gifFrame 一帧 1x1 的图像, 数据为 sub-blocks 中的内容
+func gifFrame(subBlocks ...[]byte) []byte {
+	frame := []byte{0x2c, 0, 0, 0, 0, 1, 0, 1, 0, 0, 2}
+	for _, block := range subBlocks {
+		frame = append(frame, byte(len(block)))
+		frame = append(frame, block...)
+	}
+	return append(frame, 0)
+}
+
+func gifData(globalColorTable bool, blocks ...[]byte) []byte {
+	data := []byte("GIF89a")
+	data = append(data, 1, 0, 1, 0, 0, 0, 0)
+	if globalColorTable {
+		// 2 色的全局颜色表
+		data[10] = 0x80
+		data = append(data, 0, 0, 0, 0xff, 0xff, 0xff)
+	}
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	return data
+}
+
+func TestWalkGIF(t *testing.T) {
+	// 图形控制扩展
+	extension := []byte{0x21, 0xf9, 4, 0, 10, 0, 0, 0}
+	trailer := []byte{0x3b}
+	cases := []struct {
+		name      string
+		data      []byte
+		maxFrames int
+		frames    int
+		complete  bool
+	}{
+		{"single frame", gifData(true, gifFrame([]byte{0x44, 0x01}), trailer), -1, 1, true},
+		{"no global color table", gifData(false, gifFrame([]byte{0x44, 0x01}), trailer), -1, 1, true},
+		{"extensions", gifData(true, extension, gifFrame([]byte{0x44}), extension, gifFrame([]byte{0x44}), trailer), -1, 2, true},
+		// 图像数据中的 0x3b 不是结束标记
+		{"trailer byte in image data", gifData(true, gifFrame([]byte{0x3b, 0x3b}, []byte{0x3b})), -1, 1, false},
+		{"trailer byte in image data with trailer", gifData(true, gifFrame([]byte{0x3b, 0x3b}, []byte{0x3b}), trailer), -1, 1, true},
+		{"truncated header", gifData(true)[:10], -1, 0, false},
+		{"truncated color table", gifData(true)[:15], -1, 0, false},
+		{"truncated sub block", gifData(true, gifFrame([]byte{0x44, 0x01, 0x02}))[:33], -1, 0, false},
+		{"missing trailer", gifData(true, gifFrame([]byte{0x44})), -1, 1, false},
+		{"unknown block", gifData(true, gifFrame([]byte{0x44}), []byte{0x00}, trailer), -1, 1, false},
+		// 超过 maxFrames 之后不再继续
+		{"max frames", gifData(true, gifFrame([]byte{0x44}), gifFrame([]byte{0x44}), gifFrame([]byte{0x44}), trailer), 1, 2, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frames, complete := walkGIF(bufio.NewReader(bytes.NewReader(c.data)), c.maxFrames)
+			if frames != c.frames || complete != c.complete {
+				t.Fatalf("expected %d frames, complete: %v, got %d, %v", c.frames, c.complete, frames, complete)
+			}
+		})
+	}
+}
+
+// webpVP8X 只有 VP8X chunk 的 webp 文件头
+func webpVP8X(flags byte) []byte {
+	data := []byte("RIFF\x16\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+	return append(data, flags, 0, 0, 0, 7, 0, 0, 5, 0, 0)
+}
+
+func TestIsAnimated(t *testing.T) {
+	cases := []struct {
+		name      string
+		data      []byte
+		mediaType string
+		animated  bool
+	}{
+		{"png", encodeTestImage(t, "png"), "image/png", false},
+		{"apng", apng(t), "image/png", true},
+		{"gif", encodeTestImage(t, "gif"), "image/gif", false},
+		{"animated gif", encodeTestImage(t, "animated gif"), "image/gif", true},
+		{"webp", webpVP8X(0), "image/webp", false},
+		{"animated webp", webpVP8X(0x02), "image/webp", true},
+		{"truncated webp", webpVP8X(0x02)[:16], "image/webp", false},
+		{"jpeg", encodeTestImage(t, "jpeg"), "image/jpeg", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file, err := os.Open(writeTestFile(t, c.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			animated, err := isAnimated(file, c.mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if animated != c.animated {
+				t.Fatalf("expected animated: %v, got %v", c.animated, animated)
+			}
+		})
+	}
+}
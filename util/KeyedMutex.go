@@ -0,0 +1,40 @@
+package util
+
+import "sync"
+
+// KeyedMutex 按 key 加锁, 不同的 key 互不影响, 没有人使用的 key 会被删除
+type KeyedMutex struct {
+	mtx   sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mtx  sync.Mutex
+	refs int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedMutexEntry)}
+}
+
+// Lock 锁住 key, 返回解锁的函数
+func (k *KeyedMutex) Lock(key string) func() {
+	k.mtx.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mtx.Unlock()
+	entry.mtx.Lock()
+	return func() {
+		entry.mtx.Unlock()
+		k.mtx.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mtx.Unlock()
+	}
+}
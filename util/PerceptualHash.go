@@ -0,0 +1,191 @@
+package util
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// DHashWidth, DHashHeight dHash 需要的灰度图尺寸, 每行相邻两个像素比较得到 8 bit, 共 64 bit
+const DHashWidth = 9
+const DHashHeight = 8
+
+// DHash 根据 9x8 的 8 bit 灰度图计算 dHash
+func DHash(gray []byte) (uint64, error) {
+	if len(gray) != DHashWidth*DHashHeight {
+		return 0, fmt.Errorf("invalid gray image size: %d", len(gray))
+	}
+	var hash uint64
+	for y := 0; y < DHashHeight; y++ {
+		row := gray[y*DHashWidth : (y+1)*DHashWidth]
+		for x := 0; x < DHashWidth-1; x++ {
+			hash <<= 1
+			if row[x] < row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// ClusterHashes 把距离不超过 maxDistance 的 hash 分到同一组(传递), 返回包含两个以上元素的组, 元素为 hashes 的下标
+// 把 64 bit 分成 maxDistance+1 段, 距离不超过 maxDistance 的两个 hash 至少有一段完全相同, 只需要比较这些候选
+func ClusterHashes(hashes []uint64, maxDistance int) [][]int {
+	maxDistance = max(0, min(maxDistance, 63))
+	segments := maxDistance + 1
+	parent := make([]int, len(hashes))
+	for idx := range parent {
+		parent[idx] = idx
+	}
+	var find func(int) int
+	find = func(x int) int {
+		if parent[x] != x {
+			parent[x] = find(parent[x])
+		}
+		return parent[x]
+	}
+	for segment := 0; segment < segments; segment++ {
+		from := 64 * segment / segments
+		to := 64 * (segment + 1) / segments
+		mask := (uint64(1)<<(to-from) - 1) << from
+		if to-from == 64 {
+			mask = ^uint64(0)
+		}
+		buckets := make(map[uint64][]int)
+		for idx, hash := range hashes {
+			buckets[hash&mask] = append(buckets[hash&mask], idx)
+		}
+		for _, bucket := range buckets {
+			for i := 0; i < len(bucket); i++ {
+				for j := i + 1; j < len(bucket); j++ {
+					a, b := find(bucket[i]), find(bucket[j])
+					if a != b && HammingDistance(hashes[bucket[i]], hashes[bucket[j]]) <= maxDistance {
+						parent[a] = b
+					}
+				}
+			}
+		}
+	}
+	groups := make(map[int][]int)
+	var order []int
+	for idx := range hashes {
+		root := find(idx)
+		if _, ok := groups[root]; !ok {
+			order = append(order, root)
+		}
+		groups[root] = append(groups[root], idx)
+	}
+	result := make([][]int, 0)
+	for _, root := range order {
+		if len(groups[root]) > 1 {
+			result = append(result, groups[root])
+		}
+	}
+	return result
+}
+
+// BKTree 按汉明距离索引 hash, 用于查找距离不超过某个值的 hash, 同一个 hash 可以对应多个 value
+// 子节点按和父节点的距离分组, 查询时根据三角不等式跳过不可能满足条件的子树
+type BKTree[T comparable] struct {
+	root *bkTreeNode[T]
+	size int
+}
+
+type bkTreeNode[T comparable] struct {
+	hash     uint64
+	values   []T
+	children map[int]*bkTreeNode[T]
+}
+
+// BKTreeMatch 查询的结果
+type BKTreeMatch[T comparable] struct {
+	Hash     uint64
+	Value    T
+	Distance int
+}
+
+func NewBKTree[T comparable]() *BKTree[T] {
+	return &BKTree[T]{}
+}
+
+// Len 返回 value 的数量
+func (t *BKTree[T]) Len() int {
+	return t.size
+}
+
+// Add 添加 hash 和 value, 已经存在时忽略
+func (t *BKTree[T]) Add(hash uint64, value T) {
+	if t.root == nil {
+		t.root = &bkTreeNode[T]{hash: hash, values: []T{value}}
+		t.size++
+		return
+	}
+	node := t.root
+	for {
+		distance := HammingDistance(node.hash, hash)
+		if distance == 0 {
+			if !slices.Contains(node.values, value) {
+				node.values = append(node.values, value)
+				t.size++
+			}
+			return
+		}
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkTreeNode[T])
+			}
+			node.children[distance] = &bkTreeNode[T]{hash: hash, values: []T{value}}
+			t.size++
+			return
+		}
+		node = child
+	}
+}
+
+// Remove 删除 hash 对应的 value, 节点保留用于查找子树
+func (t *BKTree[T]) Remove(hash uint64, value T) {
+	node := t.root
+	for node != nil {
+		distance := HammingDistance(node.hash, hash)
+		if distance == 0 {
+			if idx := slices.Index(node.values, value); idx >= 0 {
+				node.values = slices.Delete(node.values, idx, idx+1)
+				t.size--
+			}
+			return
+		}
+		node = node.children[distance]
+	}
+}
+
+// Search 返回距离不超过 maxDistance 的所有 value, 按距离从小到大排列
+func (t *BKTree[T]) Search(hash uint64, maxDistance int) []BKTreeMatch[T] {
+	result := make([]BKTreeMatch[T], 0)
+	if t.root == nil {
+		return result
+	}
+	pending := []*bkTreeNode[T]{t.root}
+	for len(pending) > 0 {
+		node := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		distance := HammingDistance(node.hash, hash)
+		if distance <= maxDistance {
+			for _, value := range node.values {
+				result = append(result, BKTreeMatch[T]{Hash: node.hash, Value: value, Distance: distance})
+			}
+		}
+		for childDistance, child := range node.children {
+			if childDistance >= distance-maxDistance && childDistance <= distance+maxDistance {
+				pending = append(pending, child)
+			}
+		}
+	}
+	slices.SortStableFunc(result, func(a, b BKTreeMatch[T]) int {
+		return a.Distance - b.Distance
+	})
+	return result
+}
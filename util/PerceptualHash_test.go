@@ -0,0 +1,53 @@
+package util
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestBKTreeSearchMatchesBruteForce(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewBKTree[int]()
+	hashes := make([]uint64, 2000)
+	for idx := range hashes {
+		hashes[idx] = random.Uint64()
+		if idx%3 == 0 && idx > 0 {
+			// 和前一个相近的 hash
+			hashes[idx] = hashes[idx-1] ^ 1<<(idx%64) ^ 1<<(idx*7%64)
+		}
+		tree.Add(hashes[idx], idx)
+	}
+	tree.Add(hashes[0], 0)
+	if tree.Len() != len(hashes) {
+		t.Fatalf("expected %d values, got %d", len(hashes), tree.Len())
+	}
+	for query := 0; query < 100; query++ {
+		hash := hashes[random.Intn(len(hashes))] ^ 1<<random.Intn(64)
+		for _, maxDistance := range []int{0, 2, 5, 10} {
+			expected := 0
+			for _, other := range hashes {
+				if HammingDistance(hash, other) <= maxDistance {
+					expected++
+				}
+			}
+			matches := tree.Search(hash, maxDistance)
+			if len(matches) != expected {
+				t.Fatalf("distance %d: expected %d matches, got %d", maxDistance, expected, len(matches))
+			}
+			for idx := 1; idx < len(matches); idx++ {
+				if matches[idx].Distance < matches[idx-1].Distance {
+					t.Fatalf("matches are not sorted by distance: %v", matches)
+				}
+			}
+		}
+	}
+	tree.Remove(hashes[5], 5)
+	for _, match := range tree.Search(hashes[5], 0) {
+		if match.Value == 5 {
+			t.Fatal("removed value is still found")
+		}
+	}
+	if tree.Len() != len(hashes)-1 {
+		t.Fatalf("expected %d values after remove, got %d", len(hashes)-1, tree.Len())
+	}
+}
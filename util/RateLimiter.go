@@ -0,0 +1,75 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// burst 的最小值, 不能小于单次读取的大小, 否则永远拿不到足够的令牌
+const minRateLimiterBurst = 32 * 1024
+
+// RateLimiter 令牌桶限速, rate 为 0 时不限制
+type RateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{last: time.Now()}
+}
+
+// SetLimit 修改限速, rate 单位为 bytes/s, burst 为 0 时等于 rate
+func (l *RateLimiter) SetLimit(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	newRate := float64(max(rate, 0))
+	newBurst := float64(max(burst, minRateLimiterBurst))
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if newRate == l.rate && newBurst == l.burst {
+		return
+	}
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		// 之前不限速, 桶是满的
+		l.tokens = newBurst
+	}
+	l.rate = newRate
+	l.burst = newBurst
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// Limit 返回当前的限速
+func (l *RateLimiter) Limit() (rate, burst int64) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return int64(l.rate), int64(l.burst)
+}
+
+// Reserve 取出 n 个令牌, 返回使用这些令牌之前需要等待的时间
+func (l *RateLimiter) Reserve(n int64) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+func (l *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if l.rate <= 0 {
+		l.tokens = l.burst
+		return
+	}
+	l.tokens = min(l.tokens+elapsed*l.rate, l.burst)
+}
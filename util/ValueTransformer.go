@@ -0,0 +1,69 @@
+package util
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"ywwzwb/imagespider/models/config"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// transformValue 按顺序执行变换, split 会把一个值拆成多个, capture 没有匹配到时会丢弃这个值
+func transformValue(doc *goquery.Document, value string, transforms []config.TransformConfig) []string {
+	values := []string{value}
+	for _, t := range transforms {
+		next := make([]string, 0, len(values))
+		for _, v := range values {
+			next = append(next, applyTransform(doc, v, &t)...)
+		}
+		values = next
+		if len(values) == 0 {
+			break
+		}
+	}
+	return values
+}
+func applyTransform(doc *goquery.Document, value string, t *config.TransformConfig) []string {
+	switch t.Type {
+	case config.TransformTrim:
+		if len(t.Argument) == 0 {
+			return []string{strings.TrimSpace(value)}
+		}
+		return []string{strings.Trim(value, t.Argument)}
+	case config.TransformLowercase:
+		return []string{strings.ToLower(value)}
+	case config.TransformReplace:
+		return []string{t.Regex.ReplaceAllString(value, t.Replacement)}
+	case config.TransformCapture:
+		match := t.Regex.FindStringSubmatch(value)
+		if match == nil {
+			return nil
+		}
+		return []string{match[t.Group]}
+	case config.TransformSplit:
+		result := make([]string, 0)
+		for _, item := range strings.Split(value, t.Argument) {
+			if len(strings.TrimSpace(item)) == 0 {
+				continue
+			}
+			result = append(result, item)
+		}
+		return result
+	case config.TransformResolveURL:
+		return []string{ResolveURL(doc, value)}
+	case config.TransformURLDecode:
+		if decoded, err := url.QueryUnescape(value); err == nil {
+			return []string{decoded}
+		}
+		return []string{value}
+	case config.TransformHTMLUnescape:
+		return []string{html.UnescapeString(value)}
+	case config.TransformPrefix:
+		return []string{t.Argument + value}
+	case config.TransformSuffix:
+		return []string{value + t.Argument}
+	default:
+		return []string{value}
+	}
+}